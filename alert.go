@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gitlab.com/thorchain/midgard/internal/timeseries"
+)
+
+// Tolerance is the accepted divergence of a side. A diff is within tolerance
+// when it does not exceed either the absolute amount or the basis points of
+// the node value.
+type Tolerance struct {
+	Abs int64 `json:"abs"`
+	BP  int64 `json:"bp"`
+}
+
+func (t Tolerance) exceededBy(s *side) bool {
+	diff, node := s.Diff, s.Node
+	if diff < 0 {
+		diff = -diff
+	}
+	if node < 0 {
+		node = -node
+	}
+	// float math as the e8 amounts times basis points overflow int64
+	return diff > t.Abs && float64(diff)*10000 > float64(t.BP)*float64(node)
+}
+
+func sideIndex(name string) int {
+	for i, sideName := range sideNames {
+		if sideName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Alert is the webhook payload.
+type alert struct {
+	Pool       string           `json:"pool"`
+	Side       string           `json:"side"`
+	Height     int64            `json:"height"`
+	Expected   int64            `json:"expected"` // according to thornode
+	Actual     int64            `json:"actual"`   // rebuilt from events
+	Diff       int64            `json:"diff"`
+	Tolerance  Tolerance        `json:"tolerance"`
+	Components map[string]int64 `json:"components"`
+}
+
+// Guard checks results against the configured tolerances.
+type guard struct {
+	c      *Config
+	client http.Client
+
+	// Exceeded is set once any result exceeds its tolerance.
+	exceeded bool
+	// alerts are sent on the first exceed only, per pool and side
+	alerted map[string]*[len(sideNames)]bool
+}
+
+func newGuard(c *Config) *guard {
+	return &guard{
+		c:       c,
+		client:  http.Client{Timeout: c.Alert.Timeout.WithDefault(5 * time.Second)},
+		alerted: make(map[string]*[len(sideNames)]bool),
+	}
+}
+
+// Tolerance resolves the configuration for a pool and side.
+func (g *guard) tolerance(pool string, sideIndex int) Tolerance {
+	for _, p := range [...]string{pool, "*"} {
+		sides, ok := g.c.Reconcile.Tolerances[p]
+		if !ok {
+			continue
+		}
+		for _, s := range [...]string{sideNames[sideIndex], "*"} {
+			if t, ok := sides[s]; ok {
+				return t
+			}
+		}
+	}
+	return Tolerance{}
+}
+
+func (g *guard) check(results []*result) {
+	for _, r := range results {
+		alerted, ok := g.alerted[r.Pool]
+		if !ok {
+			alerted = new([len(sideNames)]bool)
+			g.alerted[r.Pool] = alerted
+		}
+
+		for i := range r.Sides {
+			if r.Sides[i].Unreliable {
+				continue // no verdict on failed components
+			}
+			t := g.tolerance(r.Pool, i)
+			if !t.exceededBy(&r.Sides[i]) {
+				alerted[i] = false
+				continue
+			}
+
+			g.exceeded = true
+			if alerted[i] {
+				continue
+			}
+			alerted[i] = true
+			log.Printf("%s %s diff %d on height %d exceeds tolerance", r.Pool, sideNames[i], r.Sides[i].Diff, r.Height)
+			if err := g.alert(r, i, t); err != nil {
+				log.Printf("%s %s alert on height %d lost: %s", r.Pool, sideNames[i], r.Height, err)
+			}
+		}
+	}
+}
+
+func (g *guard) alert(r *result, sideIndex int, t Tolerance) error {
+	if g.c.Alert.WebhookURL == "" {
+		return nil
+	}
+
+	components := make(map[string]int64)
+	values := r.Totals.Values()
+	for i, name := range timeseries.ComponentNames() {
+		components[name] = values[i]
+	}
+	body, err := json.Marshal(&alert{
+		Pool:       r.Pool,
+		Side:       sideNames[sideIndex],
+		Height:     r.Height,
+		Expected:   r.Sides[sideIndex].Node,
+		Actual:     r.Sides[sideIndex].SQL,
+		Diff:       r.Sides[sideIndex].Diff,
+		Tolerance:  t,
+		Components: components,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := g.client.Post(g.c.Alert.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook status %q", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestToleranceExceededBy(t *testing.T) {
+	tests := []struct {
+		name       string
+		tolerance  Tolerance
+		node, diff int64
+		want       bool
+	}{
+		{"zero tolerance in sync", Tolerance{}, 1000, 0, false},
+		{"zero tolerance", Tolerance{}, 1000, 1, true},
+		{"zero tolerance negative", Tolerance{}, 1000, -1, true},
+		{"absolute within", Tolerance{Abs: 10}, 1000, 10, false},
+		{"absolute beyond", Tolerance{Abs: 10}, 1000, -11, true},
+		{"basis points within", Tolerance{BP: 100}, 1000, 10, false},
+		{"basis points beyond", Tolerance{BP: 100}, 1000, 11, true},
+		{"basis points of negative node", Tolerance{BP: 100}, -1000, 11, true},
+		{"both with absolute within", Tolerance{Abs: 20, BP: 100}, 1000, 15, false},
+		{"both with basis points within", Tolerance{Abs: 5, BP: 100}, 1000, 8, false},
+		{"both beyond", Tolerance{Abs: 5, BP: 100}, 1000, 11, true},
+		// diff times 10000 is beyond int64
+		{"large amounts within", Tolerance{BP: 10}, 9e17, 9e14, false},
+		{"large amounts beyond", Tolerance{BP: 10}, 9e17, 1e15, true},
+	}
+	for _, test := range tests {
+		s := side{Node: test.node, Diff: test.diff}
+		if got := test.tolerance.exceededBy(&s); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGuardTolerance(t *testing.T) {
+	c := testConfig()
+	c.Reconcile.Tolerances = map[string]map[string]Tolerance{
+		testPool: {"rune": {Abs: 1}, "*": {Abs: 2}},
+		"*":      {"units": {Abs: 3}, "*": {Abs: 4}},
+	}
+	g := newGuard(c)
+
+	tests := []struct {
+		pool string
+		side int
+		want int64
+	}{
+		{testPool, runeSide, 1},
+		{testPool, assetSide, 2},
+		{testPool, unitsSide, 2},
+		{"BTC.BTC", runeSide, 4},
+		{"BTC.BTC", unitsSide, 3},
+	}
+	for _, test := range tests {
+		if got := g.tolerance(test.pool, test.side); got.Abs != test.want {
+			t.Errorf("%s %s: got absolute tolerance %d, want %d", test.pool, sideNames[test.side], got.Abs, test.want)
+		}
+	}
+}
+
+func TestGuardAlert(t *testing.T) {
+	var mu sync.Mutex
+	var alerts []alert
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Error("malformed alert:", err)
+		}
+		mu.Lock()
+		alerts = append(alerts, a)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	c := testConfig()
+	c.Alert.WebhookURL = webhook.URL
+	g := newGuard(c)
+
+	// alerts on the first exceed only, until back within tolerance
+	diffs := []int64{0, 5, 6, 0, 7}
+	for i, diff := range diffs {
+		r := &result{Pool: testPool, Height: int64(i + 1)}
+		r.Sides[assetSide] = side{Node: 100, SQL: 100 - diff, Diff: diff}
+		g.check([]*result{r})
+	}
+
+	if !g.exceeded {
+		t.Error("tolerance not exceeded")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(alerts) != 2 {
+		t.Fatalf("got %d alerts, want 2", len(alerts))
+	}
+	for i, want := range []struct {
+		height, diff int64
+	}{{2, 5}, {5, 7}} {
+		a := alerts[i]
+		if a.Pool != testPool || a.Side != "asset" || a.Height != want.height || a.Diff != want.diff || a.Expected != 100 {
+			t.Errorf("alert %d: got %+v, want asset diff %d on height %d", i, a, want.diff, want.height)
+		}
+	}
+}
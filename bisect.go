@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"gitlab.com/thorchain/midgard/internal/thornode"
+	"gitlab.com/thorchain/midgard/internal/timeseries"
+)
+
+// Prober reconciles single heights on demand. Results are cached, such that
+// each (pool, height) costs one query and one node call at most.
+type prober struct {
+	store   timeseries.Store
+	node    *thornode.Client
+	results map[string]map[int64]*result
+
+	nodeCalls int
+}
+
+func newProber(store timeseries.Store, node *thornode.Client) *prober {
+	return &prober{
+		store:   store,
+		node:    node,
+		results: make(map[string]map[int64]*result),
+	}
+}
+
+func (p *prober) probe(ctx context.Context, pool string, height int64) (*result, error) {
+	if r, ok := p.results[pool][height]; ok {
+		return r, nil
+	}
+
+	queryStart := time.Now()
+	ts, totals, err := timeseries.TotalsAtHeight(ctx, p.store, height, pool)
+	if err != nil {
+		dbErrors.Inc()
+		return nil, err
+	}
+	if ts == 0 {
+		return nil, fmt.Errorf("height %d not in block_log", height)
+	}
+	heightQuerySeconds.Observe(time.Since(queryStart).Seconds())
+
+	p.nodeCalls++
+	r, err := reconcilePool(ctx, p.node, pool, height, ts, totals[pool])
+	if err != nil {
+		return nil, err
+	}
+	if p.results[pool] == nil {
+		p.results[pool] = make(map[int64]*result)
+	}
+	p.results[pool][height] = r
+	return r, nil
+}
+
+// ErrUnreliable denies a verdict on a side with failed components.
+var errUnreliable = errors.New("side unreliable due to failed components")
+
+// ProbeSide is probe with an errUnreliable when sideIndex is unreliable.
+func (p *prober) probeSide(ctx context.Context, pool string, sideIndex int, height int64) (*result, error) {
+	r, err := p.probe(ctx, pool, height)
+	if err == nil && r.Sides[sideIndex].Unreliable {
+		err = fmt.Errorf("height %d: %w", height, errUnreliable)
+	}
+	return r, err
+}
+
+// FirstDivergence finds the lowest height in [from, to] with a non-zero
+// diff, under the assumption that a divergence persists once it occurs.
+// The return is zero when no divergence is found.
+func (p *prober) firstDivergence(ctx context.Context, pool string, sideIndex int, from, to int64) (height int64, r *result, err error) {
+	r, err = p.probeSide(ctx, pool, sideIndex, from)
+	if err != nil || r.Sides[sideIndex].Diff != 0 {
+		return from, r, err
+	}
+	r, err = p.probeSide(ctx, pool, sideIndex, to)
+	if err != nil || r.Sides[sideIndex].Diff == 0 {
+		return 0, nil, err
+	}
+
+	// invariant: diff at lo is zero and diff at hi is not
+	lo, hi := from, to
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		m, err := p.probeSide(ctx, pool, sideIndex, mid)
+		if err != nil {
+			return 0, nil, err
+		}
+		if m.Sides[sideIndex].Diff != 0 {
+			hi, r = mid, m
+		} else {
+			lo = mid
+		}
+	}
+	return hi, r, nil
+}
+
+// Bisect reports the first diverging height in the configured range, per
+// pool and per side, as CSV to w. Sides which are unreliable on any of the
+// heights probed are skipped, with a log line.
+func bisect(ctx context.Context, c *Config, store timeseries.Store, node *thornode.Client, pools []string, w io.Writer) error {
+	p := newProber(store, node)
+	for _, pool := range pools {
+		for sideIndex, sideName := range sideNames {
+			height, r, err := p.firstDivergence(ctx, pool, sideIndex, c.Reconcile.FromHeight, c.Reconcile.ToHeight)
+			if errors.Is(err, errUnreliable) {
+				log.Printf("bisect %s %s skipped on %s", pool, sideName, err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("bisect %s %s: %w", pool, sideName, err)
+			}
+			if r == nil {
+				log.Printf("bisect %s %s: no divergence up to height %d", pool, sideName, c.Reconcile.ToHeight)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "%s,%s,%d,%d\n", pool, sideName, height, r.Sides[sideIndex].Diff)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("bisect done with %d node calls", p.nodeCalls)
+	return nil
+}
+
+// ChangePoints finds every height in (from, to] where the diff differs from
+// the previous height. The range is sampled at intervals first. Intervals
+// with a different diff on each end are refined recursively. Changes which
+// cancel each other out within a sample interval go unnoticed.
+func (p *prober) changePoints(ctx context.Context, pool string, sideIndex int, from, to int64, samples int, found func(height int64, prev, r *result) error) error {
+	stride := (to - from) / int64(samples)
+	if stride < 1 {
+		stride = 1
+	}
+
+	prevHeight := from
+	prev, err := p.probeSide(ctx, pool, sideIndex, from)
+	if err != nil {
+		return err
+	}
+	for height := from + stride; prevHeight < to; height += stride {
+		if height > to {
+			height = to
+		}
+		r, err := p.probeSide(ctx, pool, sideIndex, height)
+		if err != nil {
+			return err
+		}
+		if err := p.refine(ctx, pool, sideIndex, prevHeight, prev, height, r, found); err != nil {
+			return err
+		}
+		prevHeight, prev = height, r
+	}
+	return nil
+}
+
+func (p *prober) refine(ctx context.Context, pool string, sideIndex int, lo int64, loResult *result, hi int64, hiResult *result, found func(height int64, prev, r *result) error) error {
+	if loResult.Sides[sideIndex].Diff == hiResult.Sides[sideIndex].Diff {
+		return nil
+	}
+	if hi-lo == 1 {
+		return found(hi, loResult, hiResult)
+	}
+
+	mid := lo + (hi-lo)/2
+	midResult, err := p.probeSide(ctx, pool, sideIndex, mid)
+	if err != nil {
+		return err
+	}
+	if err := p.refine(ctx, pool, sideIndex, lo, loResult, mid, midResult, found); err != nil {
+		return err
+	}
+	return p.refine(ctx, pool, sideIndex, mid, midResult, hi, hiResult, found)
+}
+
+// ReportChangePoints writes every height in the configured range where the
+// diff changes, per pool and per side, as CSV to w. Each line ends with the
+// delta of each component in the block. Sides which are unreliable on any of
+// the heights probed are skipped from there on, with a log line.
+func reportChangePoints(ctx context.Context, c *Config, store timeseries.Store, node *thornode.Client, pools []string, w io.Writer) error {
+	p := newProber(store, node)
+	for _, pool := range pools {
+		for sideIndex, sideName := range sideNames {
+			err := p.changePoints(ctx, pool, sideIndex, c.Reconcile.FromHeight, c.Reconcile.ToHeight, c.Reconcile.Samples, func(height int64, prev, r *result) error {
+				diff := r.Sides[sideIndex].Diff
+				_, err := fmt.Fprintf(w, "%s,%s,%d,%d,%d", pool, sideName, height, diff, diff-prev.Sides[sideIndex].Diff)
+				if err != nil {
+					return err
+				}
+				for _, delta := range r.attribution(prev) {
+					if _, err := fmt.Fprintf(w, ",%d", delta); err != nil {
+						return err
+					}
+				}
+				_, err = io.WriteString(w, "\n")
+				return err
+			})
+			if errors.Is(err, errUnreliable) {
+				log.Printf("change points %s %s skipped on %s", pool, sideName, err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("change points %s %s: %w", pool, sideName, err)
+			}
+		}
+	}
+	log.Printf("change point detection done with %d node calls", p.nodeCalls)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Checkpoint is the progress of a run. The file offsets allow for recovery
+// of partially written heights.
+type checkpoint struct {
+	Height int64 `json:"height"`
+	// FromHeight, ToHeight and Step are the window of the run.
+	FromHeight int64 `json:"from_height"`
+	ToHeight   int64 `json:"to_height"`
+	Step       int64 `json:"step"`
+	// Offsets has the size of each file sink, by path.
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+// LoadCheckpoint reads the checkpoint file on path. The return is nil when
+// the file does not exist.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(bytes, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Resumes returns an error when the checkpoint was written in another window
+// than c has. Checkpoints without a window are accepted as is.
+func (cp *checkpoint) resumes(c *Config) error {
+	switch {
+	case cp.Step == 0:
+		return nil
+	case cp.FromHeight != c.Reconcile.FromHeight || cp.Step != c.Reconcile.Step:
+		return fmt.Errorf("checkpoint from height %d with step %d does not match the configured from height %d with step %d", cp.FromHeight, cp.Step, c.Reconcile.FromHeight, c.Reconcile.Step)
+	case cp.Height > c.Reconcile.ToHeight && cp.Height <= cp.ToHeight:
+		// heights beyond the window of the checkpoint are from live mode
+		return fmt.Errorf("checkpoint on height %d beyond the configured to height %d", cp.Height, c.Reconcile.ToHeight)
+	}
+	return nil
+}
+
+// Save writes the checkpoint file on path atomically, as in the previous
+// content is kept intact on failure.
+func (cp *checkpoint) save(path string) error {
+	bytes, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", bytes, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ResultsAPI serves the content of a postgres sink table.
+type resultsAPI struct {
+	db    *sql.DB
+	table string
+}
+
+// ResultsTable returns the table of the first postgres sink, if any.
+func resultsTable(c *Config) string {
+	for _, sc := range c.Reconcile.Sinks {
+		if sc.Type == "postgres" {
+			return sc.Table
+		}
+	}
+	return "depth_reconciliation"
+}
+
+// StartHTTPServer launches the results API on the background. Server errors
+// are fatal when required, and logged otherwise. The return stops the server
+// gracefully, within the configured shutdown timeout.
+func startHTTPServer(c *Config, db *sql.DB, required bool) (shutdown func()) {
+	if c.ListenPort == 0 {
+		c.ListenPort = 8080
+		log.Printf("default HTTP server listen port to %d", c.ListenPort)
+	}
+
+	api := resultsAPI{db: db, table: resultsTable(c)}
+	srv := &http.Server{
+		Handler:      api.handler(),
+		Addr:         fmt.Sprintf(":%d", c.ListenPort),
+		ReadTimeout:  c.ReadTimeout.WithDefault(2 * time.Second),
+		WriteTimeout: c.WriteTimeout.WithDefault(3 * time.Second),
+	}
+	go func() {
+		log.Print("HTTP server listening on ", srv.Addr)
+		err := srv.ListenAndServe()
+		switch {
+		case errors.Is(err, http.ErrServerClosed):
+			return
+		case required:
+			log.Fatal("exit on HTTP server: ", err)
+		}
+		log.Print("HTTP server unavailable: ", err)
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout.WithDefault(5*time.Second))
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Print("HTTP server shutdown: ", err)
+		}
+	}
+}
+
+// Handler routes the results API and the metrics.
+func (api *resultsAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", api.serveStatus)
+	mux.HandleFunc("/v1/pools/", api.servePool)
+	mux.Handle("/metrics", promhttp.Handler())
+	return promhttp.InstrumentHandlerDuration(apiRequestSeconds, mux)
+}
+
+// ResultColumns matches scanResult.
+const resultColumns = `pool, height, block_timestamp,
+	rune_node, rune_sql, rune_block, rune_diff,
+	asset_node, asset_sql, asset_block, asset_diff,
+	units_node, units_sql, units_diff,
+	components, deltas, coalesce(array_to_string(tables, ' '), ''), status`
+
+// ResultRows reads rows with resultColumns.
+func (api *resultsAPI) resultRows(ctx context.Context, q string, args ...interface{}) ([]*resultJSON, error) {
+	rows, err := api.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*resultJSON, 0)
+	for rows.Next() {
+		r := resultJSON{Rune: new(side), Asset: new(side), Units: new(side)}
+		// SQL and diff are NULL for unreliable sides
+		var sqls, diffs [len(sideNames)]sql.NullInt64
+		var components, deltas, status []byte
+		var tables string
+		err := rows.Scan(&r.Pool, &r.Height, &r.Timestamp,
+			&r.Rune.Node, &sqls[runeSide], &r.Rune.Block, &diffs[runeSide],
+			&r.Asset.Node, &sqls[assetSide], &r.Asset.Block, &diffs[assetSide],
+			&r.Units.Node, &sqls[unitsSide], &diffs[unitsSide],
+			&components, &deltas, &tables, &status)
+		if err != nil {
+			return nil, err
+		}
+		for i, s := range [...]*side{r.Rune, r.Asset, r.Units} {
+			s.SQL, s.Diff = sqls[i].Int64, diffs[i].Int64
+			s.Unreliable = !sqls[i].Valid || !diffs[i].Valid
+		}
+		if err := json.Unmarshal(components, &r.Components); err != nil {
+			return nil, fmt.Errorf("malformed components: %w", err)
+		}
+		if deltas != nil {
+			if err := json.Unmarshal(deltas, &r.Deltas); err != nil {
+				return nil, fmt.Errorf("malformed deltas: %w", err)
+			}
+		}
+		if tables != "" {
+			r.Tables = strings.Fields(tables)
+		}
+		if status != nil {
+			if err := json.Unmarshal(status, &r.Status); err != nil {
+				return nil, fmt.Errorf("malformed status: %w", err)
+			}
+		}
+		results = append(results, &r)
+	}
+	return results, rows.Err()
+}
+
+// ServeStatus responds with the latest result of each pool.
+func (api *resultsAPI) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	results, err := api.resultRows(r.Context(), "SELECT DISTINCT ON (pool) "+resultColumns+" FROM "+api.table+" ORDER BY pool, height DESC")
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respondJSON(w, results)
+}
+
+// ServePool routes /v1/pools/{pool}/results and
+// /v1/pools/{pool}/first-divergence.
+func (api *resultsAPI) servePool(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/pools/")
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	pool, resource := path[:i], path[i+1:]
+	switch resource {
+	case "results":
+		api.serveResults(w, r, pool)
+	case "first-divergence":
+		api.serveFirstDivergence(w, r, pool)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// MaxResults limits the size of a results response.
+const maxResults = 10000
+
+// ServeResults responds with the results of pool in the height range of the
+// optional from and to query parameters (inclusive).
+func (api *resultsAPI) serveResults(w http.ResponseWriter, r *http.Request, pool string) {
+	from, to := int64(0), int64(1<<63-1)
+	for name, p := range map[string]*int64{"from": &from, "to": &to} {
+		s := r.URL.Query().Get(name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("malformed %s height %q", name, s), http.StatusBadRequest)
+			return
+		}
+		*p = v
+	}
+
+	results, err := api.resultRows(r.Context(), "SELECT "+resultColumns+" FROM "+api.table+" WHERE pool = $1 AND height >= $2 AND height <= $3 ORDER BY height LIMIT $4", pool, from, to, maxResults)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respondJSON(w, results)
+}
+
+// ServeFirstDivergence responds with the first result of pool with a
+// non-zero diff, per side. Sides without divergence are omitted, and so are
+// unreliable sides.
+func (api *resultsAPI) serveFirstDivergence(w http.ResponseWriter, r *http.Request, pool string) {
+	divergences := make(map[string]*resultJSON)
+	for _, sideName := range sideNames {
+		results, err := api.resultRows(r.Context(), "SELECT "+resultColumns+" FROM "+api.table+" WHERE pool = $1 AND "+sideName+"_diff IS NOT NULL AND "+sideName+"_diff != 0 ORDER BY height LIMIT 1", pool)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		if len(results) != 0 {
+			divergences[sideName] = results[0]
+		}
+	}
+	respondJSON(w, divergences)
+}
+
+func respondJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print("HTTP response lost: ", err)
+	}
+}
+
+func respondError(w http.ResponseWriter, err error) {
+	log.Print("HTTP request failed: ", err)
+	http.Error(w, "results unavailable", http.StatusServiceUnavailable)
+}
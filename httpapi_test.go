@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// FakeDB records the queries of a sql.DB, and responds to each with the
+// same rows.
+type fakeDB struct {
+	mu      sync.Mutex
+	args    [][]driver.Value // per query
+	rows    [][]driver.Value
+	failure error
+}
+
+// Connect implements driver.Connector.
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+
+// Driver implements driver.Connector.
+func (db *fakeDB) Driver() driver.Driver { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("no transactions") }
+
+type fakeStmt struct{ db *fakeDB }
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("no exec")
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.args = append(s.db.args, args)
+	if s.db.failure != nil {
+		return nil, s.db.failure
+	}
+	return &fakeRows{rows: s.db.rows}, nil
+}
+
+type fakeRows struct{ rows [][]driver.Value }
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// QueryArgs returns the arguments of each query so far.
+func (db *fakeDB) queryArgs() [][]driver.Value {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.args
+}
+
+func TestResultsAPI(t *testing.T) {
+	all := []driver.Value{"BNB.BNB", int64(0), int64(1<<63 - 1), int64(maxResults)}
+	tests := []struct {
+		method, path string
+		wantStatus   int
+		wantArgs     [][]driver.Value
+	}{
+		{"GET", "/v1/status", 200, [][]driver.Value{nil}},
+		{"POST", "/v1/status", 405, nil},
+		{"GET", "/v1/pools/BNB.BNB/results", 200, [][]driver.Value{all}},
+		{"GET", "/v1/pools/BNB.BNB/results?from=10&to=20", 200, [][]driver.Value{{"BNB.BNB", int64(10), int64(20), int64(maxResults)}}},
+		{"GET", "/v1/pools/BNB.BNB/results?from=10", 200, [][]driver.Value{{"BNB.BNB", int64(10), int64(1<<63 - 1), int64(maxResults)}}},
+		{"GET", "/v1/pools/BNB.BNB/results?from=ten", 400, nil},
+		{"GET", "/v1/pools/BNB.BNB/results?to=-", 400, nil},
+		{"DELETE", "/v1/pools/BNB.BNB/results", 405, nil},
+		{"GET", "/v1/pools/BNB.BNB/first-divergence", 200, [][]driver.Value{{"BNB.BNB"}, {"BNB.BNB"}, {"BNB.BNB"}}},
+		{"GET", "/v1/pools/BNB.BNB/depths", 404, nil},
+		{"GET", "/v1/pools/results", 404, nil},
+		{"GET", "/v1/pools//results", 404, nil},
+	}
+	for _, test := range tests {
+		db := new(fakeDB)
+		api := resultsAPI{db: sql.OpenDB(db), table: "depth_reconciliation"}
+		srv := httptest.NewServer(api.handler())
+
+		req, err := http.NewRequest(test.method, srv.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		srv.Close()
+
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("%s %s: got HTTP status %d, want %d", test.method, test.path, resp.StatusCode, test.wantStatus)
+		}
+		// no arguments read as nil
+		got := db.queryArgs()
+		for i := range got {
+			if len(got[i]) == 0 {
+				got[i] = nil
+			}
+		}
+		if !reflect.DeepEqual(got, test.wantArgs) {
+			t.Errorf("%s %s: got query arguments %v, want %v", test.method, test.path, got, test.wantArgs)
+		}
+	}
+}
+
+func TestResultsAPIRows(t *testing.T) {
+	db := &fakeDB{rows: [][]driver.Value{{
+		"BNB.BNB", int64(7), int64(7000),
+		int64(1000), nil, int64(1000), nil, // unreliable rune side
+		int64(100), int64(99), int64(100), int64(1),
+		int64(10), int64(10), int64(0),
+		[]byte(`{"TotalRuneStakes":1000}`), nil, "stake_events swap_events", []byte(`{"Gas":"failed"}`),
+	}}}
+	api := resultsAPI{db: sql.OpenDB(db), table: "depth_reconciliation"}
+	srv := httptest.NewServer(api.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v1/pools/BNB.BNB/results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("got HTTP status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got content type %q", got)
+	}
+	var results []resultJSON
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal("malformed response:", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	r := results[0]
+	if r.Pool != "BNB.BNB" || r.Height != 7 || r.Timestamp != 7000 {
+		t.Errorf("got %s on height %d with block timestamp %d", r.Pool, r.Height, r.Timestamp)
+	}
+	if !r.Rune.Unreliable || r.Asset.Unreliable || r.Units.Unreliable {
+		t.Errorf("got unreliable rune %t, asset %t, units %t; want rune only", r.Rune.Unreliable, r.Asset.Unreliable, r.Units.Unreliable)
+	}
+	if r.Asset.Diff != 1 || r.Asset.SQL != 99 {
+		t.Errorf("got asset side %+v", *r.Asset)
+	}
+	if want := []string{"stake_events", "swap_events"}; !reflect.DeepEqual(r.Tables, want) {
+		t.Errorf("got tables %q, want %q", r.Tables, want)
+	}
+	if r.Components["TotalRuneStakes"] != 1000 || r.Status["Gas"] != "failed" {
+		t.Errorf("got components %v with status %v", r.Components, r.Status)
+	}
+}
+
+func TestResultsAPIFailure(t *testing.T) {
+	db := &fakeDB{failure: errors.New("connection refused")}
+	api := resultsAPI{db: sql.OpenDB(db), table: "depth_reconciliation"}
+	srv := httptest.NewServer(api.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got HTTP status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if strings.Contains(string(body), "connection refused") {
+		t.Errorf("database error exposed in %q", body)
+	}
+}
@@ -0,0 +1,94 @@
+package thornode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrNotCached signals a cache miss in offline mode.
+var ErrNotCached = errors.New("thornode: not cached")
+
+// CachedGet decodes the response of endpoint for key at height into v. The
+// cache is consulted for non-zero heights only. Absence is cached too, with
+// an empty marker file, such that ErrNotFound persists offline.
+func (c *Client) cachedGet(ctx context.Context, endpoint, key string, height int64, v interface{}) error {
+	path := "/" + endpoint + "/" + url.PathEscape(key)
+	if height != 0 {
+		path += "?height=" + strconv.FormatInt(height, 10)
+	}
+	if height == 0 || c.CacheDir == "" {
+		if c.Offline {
+			return fmt.Errorf("%w: %s", ErrNotCached, path)
+		}
+		body, err := c.get(ctx, path)
+		if err != nil {
+			return err
+		}
+		return decode(body, path, v)
+	}
+
+	dir := filepath.Join(c.CacheDir, endpoint, url.PathEscape(key))
+	file := filepath.Join(dir, strconv.FormatInt(height, 10)+".json")
+	body, err := ioutil.ReadFile(file)
+	switch {
+	case err == nil:
+		return decode(body, file, v)
+	case !os.IsNotExist(err):
+		return fmt.Errorf("thornode: cache unavailable: %w", err)
+	}
+	notFoundFile := filepath.Join(dir, strconv.FormatInt(height, 10)+".notfound")
+	_, err = os.Stat(notFoundFile)
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: %s", ErrNotFound, notFoundFile)
+	case !os.IsNotExist(err):
+		return fmt.Errorf("thornode: cache unavailable: %w", err)
+	case c.Offline:
+		return fmt.Errorf("%w: %s", ErrNotCached, path)
+	}
+
+	body, err = c.get(ctx, path)
+	if errors.Is(err, ErrNotFound) {
+		if err := writeCacheFile(notFoundFile, nil); err != nil {
+			return fmt.Errorf("thornode: cache unavailable: %w", err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err := decode(body, path, v); err != nil {
+		return err
+	}
+	if err := writeCacheFile(file, body); err != nil {
+		return fmt.Errorf("thornode: cache unavailable: %w", err)
+	}
+	return nil
+}
+
+// WriteCacheFile replaces file atomically, such that an interrupted run
+// leaves no partial entries.
+func writeCacheFile(file string, body []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func decode(body []byte, source string, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("thornode: malformed response from %s: %w", source, err)
+	}
+	return nil
+}
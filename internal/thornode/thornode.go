@@ -0,0 +1,161 @@
+// Package thornode provides a client for the THORChain node REST API.
+package thornode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound signals absence, e.g., a pool which does not exist at the
+// requested height.
+var ErrNotFound = errors.New("thornode: not found")
+
+// StatusError is an HTTP response other than 200 OK.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Body       string // abbreviated
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("thornode: HTTP status %d from %s: %q", e.StatusCode, e.URL, e.Body)
+}
+
+// Is matches ErrNotFound on HTTP status 404.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Temporary returns whether a retry may succeed.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Pool is the state of a pool.
+type Pool struct {
+	BalanceRune  int64  `json:"balance_rune,string"`
+	BalanceAsset int64  `json:"balance_asset,string"`
+	Asset        string `json:"asset"`
+	PoolUnits    int64  `json:"pool_units,string"`
+	Status       string `json:"status"`
+}
+
+// Client is a thornode REST client. Requests are retried on network errors
+// and on temporary HTTP statuses, with exponential backoff.
+type Client struct {
+	baseURL string
+	http    http.Client
+
+	// MaxRetries is the number of attempts after the first one.
+	MaxRetries int
+	// Backoff is the delay before the first retry. Each retry after
+	// doubles the delay.
+	Backoff time.Duration
+
+	// CacheDir, when set, keeps the responses of past heights on disk.
+	// Responses with height are immutable, so entries never expire. The
+	// directory should not be shared between networks.
+	CacheDir string
+	// Offline restricts requests to the CacheDir content. Absent entries
+	// fail with ErrNotCached. Cached 404s fail with ErrNotFound still.
+	Offline bool
+}
+
+// NewClient returns a client for baseURL, e.g.,
+// "http://localhost:1317/thorchain", with a timeout per request attempt.
+func NewClient(baseURL string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("thornode: malformed base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("thornode: base URL %q is not HTTP", baseURL)
+	}
+
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		http:       http.Client{Timeout: timeout},
+		MaxRetries: 3,
+		Backoff:    200 * time.Millisecond,
+	}, nil
+}
+
+// Pool gets the state of a pool at a height. Zero height means latest.
+func (c *Client) Pool(ctx context.Context, asset string, height int64) (*Pool, error) {
+	var pool Pool
+	if err := c.cachedGet(ctx, "pool", asset, height, &pool); err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+// Get returns the response body of path, with retries.
+func (c *Client) get(ctx context.Context, path string) ([]byte, error) {
+	delay := c.Backoff
+	for attempt := 0; ; attempt++ {
+		body, err := c.getOnce(ctx, path)
+		if err == nil || attempt >= c.MaxRetries || !temporary(err) {
+			return body, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w; retry abandoned: %s", err, ctx.Err())
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) getOnce(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("thornode: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("thornode: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return nil, &StatusError{URL: req.URL.String(), StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("thornode: response from %s: %w", req.URL, err)
+	}
+	var raw json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("thornode: malformed response from %s: %w", req.URL, err)
+	}
+	return body, nil
+}
+
+// Temporary returns whether err may resolve on retry.
+func temporary(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	var jsonErr *json.SyntaxError
+	if errors.As(err, &jsonErr) {
+		return false
+	}
+	// network errors, including timeouts
+	return !errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,174 @@
+package thornode_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.com/thorchain/midgard/internal/thornode"
+	"gitlab.com/thorchain/midgard/internal/thornode/thornodetest"
+)
+
+const testAsset = "BNB.BNB"
+
+func testPool() thornode.Pool {
+	return thornode.Pool{BalanceRune: 1000, BalanceAsset: 100, Asset: testAsset, PoolUnits: 10, Status: "Enabled"}
+}
+
+// NewTestClient returns a client for srv with a short backoff.
+func newTestClient(t *testing.T, srv *thornodetest.Server) *thornode.Client {
+	t.Helper()
+	client, err := thornode.NewClient(srv.URL, time.Second)
+	if err != nil {
+		t.Fatal("client:", err)
+	}
+	client.Backoff = time.Millisecond
+	return client
+}
+
+func TestPool(t *testing.T) {
+	tests := []struct {
+		name         string
+		asset        string
+		failStatus   int
+		failCount    int
+		wantStatus   int // of StatusError, zero for success
+		wantRequests int
+	}{
+		{"success", testAsset, 0, 0, 0, 1},
+		{"retry on unavailable", testAsset, http.StatusServiceUnavailable, 2, 0, 3},
+		{"retry on rate limit", testAsset, http.StatusTooManyRequests, 1, 0, 2},
+		{"retries exhausted", testAsset, http.StatusInternalServerError, 4, http.StatusInternalServerError, 4},
+		{"no retry on bad request", testAsset, http.StatusBadRequest, 1, http.StatusBadRequest, 1},
+		{"no retry on not found", "BTC.BTC", 0, 0, http.StatusNotFound, 1},
+	}
+	for _, test := range tests {
+		srv := thornodetest.NewServer()
+		srv.SetPool(1, testPool())
+		srv.FailNext(test.failStatus, test.failCount)
+		client := newTestClient(t, srv)
+
+		pool, err := client.Pool(context.Background(), test.asset, 2)
+		if test.wantStatus == 0 {
+			if err != nil {
+				t.Errorf("%s: got error: %s", test.name, err)
+			} else if *pool != testPool() {
+				t.Errorf("%s: got %+v, want %+v", test.name, *pool, testPool())
+			}
+		} else {
+			var statusErr *thornode.StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != test.wantStatus {
+				t.Errorf("%s: got error %v, want HTTP status %d", test.name, err, test.wantStatus)
+			}
+			if got, want := errors.Is(err, thornode.ErrNotFound), test.wantStatus == http.StatusNotFound; got != want {
+				t.Errorf("%s: got ErrNotFound %t, want %t", test.name, got, want)
+			}
+		}
+		if got := srv.Requests(); got != test.wantRequests {
+			t.Errorf("%s: got %d requests, want %d", test.name, got, test.wantRequests)
+		}
+		srv.Close()
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantNotFound  bool
+		wantTemporary bool
+	}{
+		{http.StatusBadRequest, false, false},
+		{http.StatusNotFound, true, false},
+		{http.StatusTooManyRequests, false, true},
+		{http.StatusInternalServerError, false, true},
+		{http.StatusServiceUnavailable, false, true},
+	}
+	for _, test := range tests {
+		err := &thornode.StatusError{StatusCode: test.status}
+		if got := errors.Is(err, thornode.ErrNotFound); got != test.wantNotFound {
+			t.Errorf("HTTP status %d: got ErrNotFound %t, want %t", test.status, got, test.wantNotFound)
+		}
+		if got := err.Temporary(); got != test.wantTemporary {
+			t.Errorf("HTTP status %d: got temporary %t, want %t", test.status, got, test.wantTemporary)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thornode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := thornodetest.NewServer()
+	defer srv.Close()
+	srv.SetPool(10, testPool())
+	client := newTestClient(t, srv)
+	client.CacheDir = dir
+
+	// each height once, including the absence of the pool
+	for i := 0; i < 2; i++ {
+		if _, err := client.Pool(context.Background(), testAsset, 10); err != nil {
+			t.Fatal("pool on height 10:", err)
+		}
+		if _, err := client.Pool(context.Background(), testAsset, 5); !errors.Is(err, thornode.ErrNotFound) {
+			t.Fatalf("pool on height 5: got error %v, want ErrNotFound", err)
+		}
+	}
+	if got := srv.Requests(); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+
+	// the latest state is not cached
+	for i := 0; i < 2; i++ {
+		if _, err := client.Pool(context.Background(), testAsset, 0); err != nil {
+			t.Fatal("latest pool:", err)
+		}
+	}
+	if got := srv.Requests(); got != 4 {
+		t.Errorf("got %d requests, want 4", got)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thornode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := thornodetest.NewServer()
+	defer srv.Close()
+	srv.SetPool(10, testPool())
+	client := newTestClient(t, srv)
+	client.CacheDir = dir
+	client.Pool(context.Background(), testAsset, 10)
+	client.Pool(context.Background(), testAsset, 5)
+	requests := srv.Requests()
+
+	client.Offline = true
+	pool, err := client.Pool(context.Background(), testAsset, 10)
+	if err != nil {
+		t.Fatal("cached pool:", err)
+	}
+	if *pool != testPool() {
+		t.Errorf("got cached %+v, want %+v", *pool, testPool())
+	}
+	if _, err := client.Pool(context.Background(), testAsset, 5); !errors.Is(err, thornode.ErrNotFound) {
+		t.Errorf("cached absence: got error %v, want ErrNotFound", err)
+	}
+	if _, err := client.Pool(context.Background(), testAsset, 20); !errors.Is(err, thornode.ErrNotCached) {
+		t.Errorf("height not cached: got error %v, want ErrNotCached", err)
+	}
+	if _, err := client.Pool(context.Background(), testAsset, 0); !errors.Is(err, thornode.ErrNotCached) {
+		t.Errorf("latest: got error %v, want ErrNotCached", err)
+	}
+	if got := srv.Requests(); got != requests {
+		t.Errorf("got %d requests offline", got-requests)
+	}
+}
@@ -0,0 +1,105 @@
+// Package thornodetest provides a thornode stand-in for tests.
+package thornodetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitlab.com/thorchain/midgard/internal/thornode"
+)
+
+// Server serves /pool/{asset}?height=N from the states set. The URL is the
+// base URL for thornode.NewClient.
+type Server struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// state changes per pool, in height order
+	pools map[string][]poolAt
+	// pending failures
+	failStatus int
+	failCount  int
+	requests   int
+}
+
+type poolAt struct {
+	height int64
+	pool   thornode.Pool
+}
+
+// NewServer starts a stand-in without any pools. Close it when done.
+func NewServer() *Server {
+	s := &Server{pools: make(map[string][]poolAt)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SetPool sets the state of p.Asset from height onwards.
+func (s *Server) SetPool(height int64, p thornode.Pool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := append(s.pools[p.Asset], poolAt{height, p})
+	sort.SliceStable(states, func(i, j int) bool { return states[i].height < states[j].height })
+	s.pools[p.Asset] = states
+}
+
+// FailNext responds to the next count requests with status.
+func (s *Server) FailNext(status, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failStatus, s.failCount = status, count
+}
+
+// Requests returns the number of requests served.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	if s.failCount > 0 {
+		s.failCount--
+		http.Error(w, "failure on request", s.failStatus)
+		return
+	}
+
+	asset := strings.TrimPrefix(r.URL.Path, "/pool/")
+	if r.Method != http.MethodGet || asset == r.URL.Path || asset == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var height int64
+	if param := r.URL.Query().Get("height"); param != "" {
+		var err error
+		height, err = strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			http.Error(w, "malformed height", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// last state change up to height, if any
+	var p *thornode.Pool
+	for i, state := range s.pools[asset] {
+		if height != 0 && state.height > height {
+			break
+		}
+		p = &s.pools[asset][i].pool
+	}
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,262 @@
+// Package timeseriestest provides an in-memory timeseries.Store for tests.
+package timeseriestest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gitlab.com/thorchain/midgard/internal/timeseries"
+)
+
+// Store is an in-memory timeseries.Store. The component conditions are not
+// evaluated. Instead, the events are registered per component name.
+type Store struct {
+	Blocks []Block
+	// Events has the rows per component name, e.g., "TotalRuneStakes"
+	// or "BlockDepth". Pools are the ones with a "BlockDepth" event.
+	Events map[string][]Event
+	// Rune is the return of DetectRuneAsset.
+	Rune string
+	// Err, when set, fails the queries of the respective component name.
+	Err map[string]error
+}
+
+// Block is a block_log entry.
+type Block struct {
+	Height    int64
+	Timestamp int // block timestamp
+	Hash      []byte
+	AggState  []byte
+}
+
+// Event is a component value of a pool in a block.
+type Event struct {
+	Pool      string
+	Timestamp int           // block timestamp
+	E8        sql.NullInt64 // NULL when not Valid
+}
+
+// Timestamp implements the timeseries.Store interface.
+func (s *Store) Timestamp(ctx context.Context, height int64) (int, error) {
+	for _, b := range s.Blocks {
+		if b.Height == height {
+			return b.Timestamp, nil
+		}
+	}
+	return 0, nil
+}
+
+// Pools implements the timeseries.Store interface.
+func (s *Store) Pools(ctx context.Context) (pools []string, firstSeen []int, err error) {
+	since := make(map[string]int)
+	for _, e := range s.Events["BlockDepth"] {
+		if ts, ok := since[e.Pool]; !ok || e.Timestamp < ts {
+			since[e.Pool] = e.Timestamp
+		}
+	}
+	for pool := range since {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	for _, pool := range pools {
+		firstSeen = append(firstSeen, since[pool])
+	}
+	return pools, firstSeen, nil
+}
+
+// DetectRuneAsset implements the timeseries.Store interface.
+func (s *Store) DetectRuneAsset(ctx context.Context) (string, error) {
+	return s.Rune, nil
+}
+
+// Totals implements the timeseries.Store interface.
+func (s *Store) Totals(ctx context.Context, c *timeseries.Component, ts int) (timeseries.Rows, error) {
+	if err := s.err(ctx, c); err != nil {
+		return nil, err
+	}
+	rows := new(memRows)
+	for _, e := range s.Events[c.Name] {
+		if e.Timestamp == ts || (!c.Point && e.Timestamp < ts) {
+			rows.add(e.Pool, e.E8)
+		}
+	}
+	sort.Slice(rows.rows, func(i, j int) bool {
+		return rows.rows[i][0].(string) < rows.rows[j][0].(string)
+	})
+	return rows, nil
+}
+
+// Deltas implements the timeseries.Store interface.
+func (s *Store) Deltas(ctx context.Context, c *timeseries.Component, from, to int) (timeseries.Rows, error) {
+	if err := s.err(ctx, c); err != nil {
+		return nil, err
+	}
+	rows := new(memRows)
+	for _, e := range s.Events[c.Name] {
+		if e.Timestamp > from && e.Timestamp <= to {
+			rows.add(e.Pool, e.Timestamp, e.E8)
+		}
+	}
+	sort.Slice(rows.rows, func(i, j int) bool {
+		a, b := rows.rows[i], rows.rows[j]
+		if a[1].(int) != b[1].(int) {
+			return a[1].(int) < b[1].(int)
+		}
+		return a[0].(string) < b[0].(string)
+	})
+	return rows, nil
+}
+
+// HeightTotals implements the timeseries.Store interface.
+func (s *Store) HeightTotals(ctx context.Context, components []*timeseries.Component, height int64, pool string) (timeseries.Rows, error) {
+	ts, err := s.Timestamp(ctx, height)
+	if err != nil || ts == 0 {
+		return new(memRows), err
+	}
+
+	all := &memRows{rows: [][]interface{}{{-1, "", sql.NullInt64{Int64: int64(ts), Valid: true}}}}
+	for i, c := range components {
+		rows, err := s.Totals(ctx, c, ts)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows.(*memRows).rows {
+			if pool == "" || row[0] == pool {
+				all.rows = append(all.rows, append([]interface{}{i}, row...))
+			}
+		}
+	}
+	return all, nil
+}
+
+func (s *Store) err(ctx context.Context, c *timeseries.Component) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Err[c.Name]
+}
+
+// LastBlock implements the timeseries.Store interface.
+func (s *Store) LastBlock(ctx context.Context) (height int64, timestamp time.Time, hash, aggState []byte, err error) {
+	var last *Block
+	for i := range s.Blocks {
+		if last == nil || s.Blocks[i].Height > last.Height {
+			last = &s.Blocks[i]
+		}
+	}
+	if last == nil {
+		return 0, time.Time{}, nil, nil, nil
+	}
+	return last.Height, time.Unix(0, int64(last.Timestamp)), last.Hash, last.AggState, nil
+}
+
+// CommitBlock implements the timeseries.Store interface.
+func (s *Store) CommitBlock(ctx context.Context, height int64, timestamp time.Time, hash, aggState []byte) (inserted bool, err error) {
+	for _, b := range s.Blocks {
+		if b.Height == height {
+			return false, nil
+		}
+	}
+	s.Blocks = append(s.Blocks, Block{Height: height, Timestamp: int(timestamp.UnixNano()), Hash: hash, AggState: aggState})
+	return true, nil
+}
+
+// MemRows sums the values per key, as in a SQL group by with sum. The key
+// is all but the last column.
+type memRows struct {
+	rows [][]interface{}
+	i    int
+}
+
+func (r *memRows) add(columns ...interface{}) {
+	key, e8 := columns[:len(columns)-1], columns[len(columns)-1].(sql.NullInt64)
+	for _, row := range r.rows {
+		if equalKeys(row[:len(row)-1], key) {
+			sum := row[len(row)-1].(sql.NullInt64)
+			if e8.Valid {
+				sum.Int64 += e8.Int64
+				sum.Valid = true
+			}
+			row[len(row)-1] = sum
+			return
+		}
+	}
+	r.rows = append(r.rows, append([]interface{}(nil), columns...))
+}
+
+func equalKeys(a, b []interface{}) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *memRows) Next() bool {
+	if r.i >= len(r.rows) {
+		return false
+	}
+	r.i++
+	return true
+}
+
+func (r *memRows) Scan(dest ...interface{}) error {
+	if r.i == 0 || r.i > len(r.rows) {
+		return errors.New("scan without row")
+	}
+	row := r.rows[r.i-1]
+	if len(dest) != len(row) {
+		return fmt.Errorf("scan of %d columns into %d destinations", len(row), len(dest))
+	}
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *string:
+			*d = row[i].(string)
+		case *int:
+			*d = row[i].(int)
+		case *sql.NullInt64:
+			*d = row[i].(sql.NullInt64)
+		case *int64:
+			v := row[i].(sql.NullInt64)
+			if !v.Valid {
+				return errors.New("scan of NULL into *int64")
+			}
+			*d = v.Int64
+		default:
+			return fmt.Errorf("scan into %T not supported", d)
+		}
+	}
+	return nil
+}
+
+func (r *memRows) Err() error   { return nil }
+func (r *memRows) Close() error { return nil }
+
+// AddBlock appends a block_log entry.
+func (s *Store) AddBlock(height int64, blockTimestamp int) {
+	s.Blocks = append(s.Blocks, Block{Height: height, Timestamp: blockTimestamp})
+}
+
+// AddEvent appends a value of component name for pool in the block with
+// blockTimestamp.
+func (s *Store) AddEvent(name, pool string, blockTimestamp int, e8 int64) {
+	s.addEvent(name, Event{Pool: pool, Timestamp: blockTimestamp, E8: sql.NullInt64{Int64: e8, Valid: true}})
+}
+
+// AddNull appends a NULL value of component name for pool in the block with
+// blockTimestamp.
+func (s *Store) AddNull(name, pool string, blockTimestamp int) {
+	s.addEvent(name, Event{Pool: pool, Timestamp: blockTimestamp})
+}
+
+func (s *Store) addEvent(name string, e Event) {
+	if s.Events == nil {
+		s.Events = make(map[string][]Event)
+	}
+	s.Events[name] = append(s.Events[name], e)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gitlab.com/thorchain/midgard/chain"
+	"gitlab.com/thorchain/midgard/internal/thornode"
+	"gitlab.com/thorchain/midgard/internal/timeseries"
+)
+
+// CommitPollInterval is the wait time between block_log lookups for a block
+// which is not committed yet.
+const commitPollInterval = 500 * time.Millisecond
+
+// ReconcileLive drains the blocks channel. Each block is reconciled once it
+// is committed to block_log. Blocks up to and including ToHeight are skipped.
+// Without a pool selection, all pools with events are reconciled, including
+// the ones created after startup. The totals are kept in a Stream, which
+// reads only the rows of each new block. Cancellation of ctx stops the run
+// after the height in progress, if it completes.
+func reconcileLive(ctx context.Context, c *Config, store timeseries.Store, node *thornode.Client, blocks <-chan chain.Block, write func(height int64, results []*result) error) error {
+	fromTimeStamp, err := store.Timestamp(ctx, c.Reconcile.ToHeight)
+	if err != nil {
+		dbErrors.Inc()
+		return err
+	}
+	if fromTimeStamp == 0 {
+		return fmt.Errorf("height %d not in block_log", c.Reconcile.ToHeight)
+	}
+	stream, err := timeseries.OpenStream(ctx, store, fromTimeStamp, fromTimeStamp)
+	if err != nil {
+		dbErrors.Inc()
+		return err
+	}
+	defer stream.Close()
+
+	// previous result per pool
+	prevs := make(map[string]*result)
+
+	for {
+		var block chain.Block
+		var ok bool
+		select {
+		case block, ok = <-blocks:
+			if !ok {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if block.Height <= c.Reconcile.ToHeight {
+			continue
+		}
+
+		blockTimeStamp, err := awaitCommit(ctx, store, block.Height)
+		if err != nil {
+			dbErrors.Inc()
+			return fmt.Errorf("await commit of height %d: %w", block.Height, err)
+		}
+		// the lag metric counts from the last block
+		if lastHeight, _, _, _, err := store.LastBlock(ctx); err != nil {
+			dbErrors.Inc()
+			log.Print("last block lookup: ", err)
+		} else {
+			observeLastBlock(lastHeight)
+		}
+		queryStart := time.Now()
+		if err := stream.Extend(blockTimeStamp); err != nil {
+			dbErrors.Inc()
+			return err
+		}
+		if err := stream.Advance(blockTimeStamp); err != nil {
+			dbErrors.Inc()
+			return err
+		}
+		heightQuerySeconds.Observe(time.Since(queryStart).Seconds())
+
+		known := stream.Pools()
+		pools := c.Reconcile.Pools
+		if len(pools) == 0 {
+			pools = known
+		}
+
+		var results []*result
+		for _, pool := range pools {
+			if i := sort.SearchStrings(known, pool); i == len(known) || known[i] != pool {
+				continue // pool not created yet
+			}
+			r, err := reconcilePool(ctx, node, pool, block.Height, blockTimeStamp, stream.Totals(pool))
+			if err != nil {
+				return err
+			}
+			r.Tables = stream.Tables(pool)
+			r.attribute(prevs[pool])
+			prevs[pool] = r
+			results = append(results, r)
+		}
+		if err := write(block.Height, results); err != nil {
+			return fmt.Errorf("write height %d: %w", block.Height, err)
+		}
+		log.Print("reconciled live height ", block.Height)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// AwaitCommit polls block_log until height is present.
+func awaitCommit(ctx context.Context, store timeseries.Store, height int64) (blockTimeStamp int, err error) {
+	for {
+		blockTimeStamp, err = store.Timestamp(ctx, height)
+		if err != nil || blockTimeStamp != 0 {
+			return blockTimeStamp, err
+		}
+		select {
+		case <-time.After(commitPollInterval):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are served on /metrics by the HTTP server.
+var (
+	diffGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "midgard",
+		Subsystem: "reconcile",
+		Name:      "diff",
+		Help:      "Node value minus the value rebuilt from events, as of the last height reconciled.",
+	}, []string{"pool", "side"})
+
+	heightsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "midgard",
+		Subsystem: "reconcile",
+		Name:      "heights_total",
+		Help:      "Number of heights reconciled.",
+	})
+
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "midgard",
+		Subsystem: "reconcile",
+		Name:      "errors_total",
+		Help:      "Number of failures per source, either node or db.",
+	}, []string{"source"})
+	nodeErrors = errorsTotal.WithLabelValues("node")
+	dbErrors   = errorsTotal.WithLabelValues("db")
+
+	heightQuerySeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "midgard",
+		Subsystem: "reconcile",
+		Name:      "height_query_seconds",
+		Help:      "Database latency per height.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+
+	nodeRequestSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "midgard",
+		Subsystem: "reconcile",
+		Name:      "node_request_seconds",
+		Help:      "Thornode HTTP latency per request.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 3, 8),
+	})
+
+	apiRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "midgard",
+		Subsystem: "reconcile",
+		Name:      "api_request_seconds",
+		Help:      "Results API latency per request.",
+	}, []string{"code"})
+
+	// ReconciledHeight is the last height reconciled.
+	reconciledHeight int64
+	// LastBlockHeight is the last height in block_log, as last seen.
+	lastBlockHeight int64
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "midgard",
+		Subsystem: "reconcile",
+		Name:      "lag_blocks",
+		Help:      "Number of blocks in block_log beyond the last height reconciled.",
+	}, func() float64 {
+		lag := atomic.LoadInt64(&lastBlockHeight) - atomic.LoadInt64(&reconciledHeight)
+		if lag < 0 {
+			return 0
+		}
+		return float64(lag)
+	})
+)
+
+// ObserveHeight updates the metrics with the results of a height. The diff
+// of unreliable sides is withdrawn rather than reported.
+func observeHeight(height int64, results []*result) {
+	for _, r := range results {
+		for i := range r.Sides {
+			if r.Sides[i].Unreliable {
+				diffGauge.DeleteLabelValues(r.Pool, sideNames[i])
+				continue
+			}
+			diffGauge.WithLabelValues(r.Pool, sideNames[i]).Set(float64(r.Sides[i].Diff))
+		}
+	}
+	heightsTotal.Inc()
+	atomic.StoreInt64(&reconciledHeight, height)
+}
+
+// ObserveLastBlock updates the block_log height for the lag metric.
+func observeLastBlock(height int64) {
+	atomic.StoreInt64(&lastBlockHeight, height)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/thorchain/midgard/internal/thornode"
+	"gitlab.com/thorchain/midgard/internal/timeseries"
+)
+
+// Job is the reconciliation of one height.
+type job struct {
+	height int64
+	ts     int
+	pools  []string
+	totals []timeseries.Midgard
+	tables [][]string
+
+	// results in pool order, once done
+	done chan []*result
+	// err is set before done on failure
+	err error
+}
+
+// ProgressInterval is the minimum time between progress log lines.
+const progressInterval = 10 * time.Second
+
+// ReconcileRange reconciles the configured height range. The event stream
+// is walked by a single routine, while the node lookups are spread over the
+// configured number of workers. Results are passed to write per height, in
+// height order regardless. Any error from write aborts the run. A resumed run
+// reconciles the height before FromHeight too, without write, such that the
+// first height gets the same Deltas and Tables as without interruption.
+// Cancellation of ctx stops the run after the height in progress, if it
+// completes.
+func reconcileRange(ctx context.Context, c *Config, store timeseries.Store, node *thornode.Client, pools []string, firstSeen []int, resumed bool, write func(height int64, results []*result) error) error {
+	startHeight := c.Reconcile.FromHeight
+	if resumed {
+		startHeight -= c.Reconcile.Step
+	}
+	fromTimeStamp, err := store.Timestamp(ctx, startHeight)
+	if err == nil && fromTimeStamp == 0 {
+		err = fmt.Errorf("height %d not in block_log", startHeight)
+	}
+	if err != nil {
+		return fmt.Errorf("resolve from height: %w", err)
+	}
+	toTimeStamp, err := store.Timestamp(ctx, c.Reconcile.ToHeight)
+	if err == nil && toTimeStamp == 0 {
+		err = fmt.Errorf("height %d not in block_log", c.Reconcile.ToHeight)
+	}
+	if err != nil {
+		return fmt.Errorf("resolve to height: %w", err)
+	}
+	stream, err := timeseries.OpenStream(ctx, store, fromTimeStamp, toTimeStamp)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// The capacity of ordered bounds the number of heights in progress.
+	todo := make(chan *job)
+	ordered := make(chan *job, 2*c.Reconcile.Workers)
+	for i := 0; i < c.Reconcile.Workers; i++ {
+		go func() {
+			for j := range todo {
+				results := make([]*result, len(j.pools))
+				for i, pool := range j.pools {
+					r, err := reconcilePool(ctx, node, pool, j.height, j.ts, j.totals[i])
+					if err != nil {
+						j.err = err
+						break
+					}
+					r.Tables = j.tables[i]
+					results[i] = r
+				}
+				j.done <- results
+			}
+		}()
+	}
+
+	// feed jobs in height order
+	streamErr := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(todo)
+		defer close(ordered)
+
+		lastProgress := time.Now()
+		for offset := startHeight; offset <= c.Reconcile.ToHeight; offset += c.Reconcile.Step {
+			if time.Since(lastProgress) >= progressInterval {
+				log.Printf("reconcile progress at height %d of %d", offset, c.Reconcile.ToHeight)
+				lastProgress = time.Now()
+			}
+			queryStart := time.Now()
+			blockTimeStamp, err := store.Timestamp(ctx, offset)
+			if err == nil && blockTimeStamp == 0 {
+				err = fmt.Errorf("height %d not in block_log", offset)
+			}
+			if err != nil {
+				dbErrors.Inc()
+				streamErr <- fmt.Errorf("resolve height %d: %w", offset, err)
+				return
+			}
+			if err := stream.Advance(blockTimeStamp); err != nil {
+				dbErrors.Inc()
+				streamErr <- err
+				return
+			}
+			heightQuerySeconds.Observe(time.Since(queryStart).Seconds())
+
+			j := job{height: offset, ts: blockTimeStamp, done: make(chan []*result, 1)}
+			for i, pool := range pools {
+				if blockTimeStamp < firstSeen[i] {
+					continue // pool not created yet
+				}
+				j.pools = append(j.pools, pool)
+				j.totals = append(j.totals, stream.Totals(pool))
+				j.tables = append(j.tables, stream.Tables(pool))
+			}
+			select {
+			case ordered <- &j:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case todo <- &j:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// previous result per pool
+	prevs := make(map[string]*result, len(pools))
+
+	for j := range ordered {
+		results := <-j.done
+		if j.err != nil {
+			return j.err
+		}
+		for _, r := range results {
+			r.attribute(prevs[r.Pool])
+			prevs[r.Pool] = r
+		}
+		if j.height < c.Reconcile.FromHeight {
+			continue // written before resume
+		}
+		if err := write(j.height, results); err != nil {
+			return fmt.Errorf("write height %d: %w", j.height, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case err := <-streamErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Sides of a pool, as in the index of result.Sides.
+const (
+	runeSide = iota
+	assetSide
+	unitsSide
+)
+
+var sideNames = [...]string{"rune", "asset", "units"}
+
+// Result is the reconciliation of a pool at a height.
+type result struct {
+	Pool      string
+	Height    int64
+	Timestamp int
+	Sides     [3]side
+
+	Totals timeseries.Midgard
+	// Tables has the event tables with rows since the previous result.
+	Tables []string
+	// Deltas has the change of each component since the previous result,
+	// in the order of timeseries.ComponentNames, when the diff changed.
+	Deltas []int64
+}
+
+// Side is a reconciliation of either depth or units.
+type side struct {
+	Node  int64 `json:"node"`  // according to thornode
+	SQL   int64 `json:"sql"`   // rebuilt from events
+	Block int64 `json:"block"` // according to block_pool_depths; zero for units
+	Diff  int64 `json:"diff"`  // Node minus SQL
+
+	// Unreliable is set when any of the components in SQL failed.
+	Unreliable bool `json:"unreliable,omitempty"`
+}
+
+// DiffChanged returns whether any of the sides has a different diff than
+// prev. A nil prev has no change.
+func (r *result) diffChanged(prev *result) bool {
+	if prev == nil {
+		return false
+	}
+	for i := range r.Sides {
+		if r.Sides[i].Diff != prev.Sides[i].Diff {
+			return true
+		}
+	}
+	return false
+}
+
+// Attribution returns the delta of each component since prev, in the order
+// of timeseries.ComponentNames.
+func (r *result) attribution(prev *result) []int64 {
+	deltas := r.Totals.Values()
+	for i, v := range prev.Totals.Values() {
+		deltas[i] -= v
+	}
+	return deltas
+}
+
+// Attribute sets the Deltas when the diff changed since prev.
+func (r *result) attribute(prev *result) {
+	if r.diffChanged(prev) {
+		r.Deltas = r.attribution(prev)
+	}
+}
+
+// Statuses returns the state of each component which is not plainly
+// present, in the order of timeseries.ComponentNames.
+func (r *result) statuses() (names, statuses []string) {
+	for i, name := range timeseries.ComponentNames() {
+		if i < len(r.Totals.Status) && r.Totals.Status[i] != timeseries.Present {
+			names = append(names, name)
+			statuses = append(statuses, r.Totals.Status[i].String())
+		}
+	}
+	return names, statuses
+}
+
+// StatusMap returns the statuses keyed by component name.
+func (r *result) statusMap() map[string]string {
+	names, statuses := r.statuses()
+	m := make(map[string]string, len(names))
+	for i, name := range names {
+		m[name] = statuses[i]
+	}
+	return m
+}
+
+// FormatSQL returns the CSV representation of v, which is derived from SQL.
+// Unreliable sides are left blank.
+func (s *side) formatSQL(v int64) string {
+	if s.Unreliable {
+		return ""
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// Record returns the CSV representation. The SQL and diff columns of
+// unreliable sides are left blank. The component deltas and the event
+// tables are left blank when the diff did not change. The last column lists
+// each component which is missing, zero or failed, as name:status.
+func (r *result) record() []string {
+	rs, as, us := &r.Sides[runeSide], &r.Sides[assetSide], &r.Sides[unitsSide]
+	record := []string{r.Pool, strconv.FormatInt(r.Height, 10), strconv.Itoa(r.Timestamp),
+		strconv.FormatInt(rs.Node, 10), rs.formatSQL(rs.SQL), strconv.FormatInt(rs.Block, 10), rs.formatSQL(rs.Diff),
+		strconv.FormatInt(as.Node, 10), as.formatSQL(as.SQL), strconv.FormatInt(as.Block, 10), as.formatSQL(as.Diff),
+		strconv.FormatInt(us.Node, 10), us.formatSQL(us.SQL), us.formatSQL(us.Diff),
+	}
+
+	if r.Deltas == nil {
+		record = append(record, make([]string, len(timeseries.ComponentNames())+1)...)
+	} else {
+		for _, delta := range r.Deltas {
+			record = append(record, strconv.FormatInt(delta, 10))
+		}
+		record = append(record, strings.Join(r.Tables, " "))
+	}
+
+	names, statuses := r.statuses()
+	for i := range names {
+		names[i] += ":" + statuses[i]
+	}
+	return append(record, strings.Join(names, " "))
+}
+
+// ReconcilePool compares the node's view of pool at height with the depths
+// rebuilt from events, as defined by the formula in use.
+func reconcilePool(ctx context.Context, thorNode *thornode.Client, pool string, height int64, blockTimeStamp int, mg timeseries.Midgard) (*result, error) {
+	requestStart := time.Now()
+	node, err := thorNode.Pool(ctx, pool, height)
+	nodeRequestSeconds.Observe(time.Since(requestStart).Seconds())
+	if errors.Is(err, thornode.ErrNotFound) {
+		node, err = new(thornode.Pool), nil // not created yet
+	}
+	if err != nil {
+		nodeErrors.Inc()
+		return nil, fmt.Errorf("pool %s on height %d: %w", pool, height, err)
+	}
+
+	r := result{Pool: pool, Height: height, Timestamp: blockTimeStamp, Totals: mg}
+	r.Sides[runeSide].Node = node.BalanceRune
+	r.Sides[runeSide].SQL = mg.Depth(sideNames[runeSide])
+	r.Sides[runeSide].Block = mg.BlockDepth
+	r.Sides[assetSide].Node = node.BalanceAsset
+	r.Sides[assetSide].SQL = mg.Depth(sideNames[assetSide])
+	r.Sides[assetSide].Block = mg.BlockAssetDepth
+	r.Sides[unitsSide].Node = node.PoolUnits
+	r.Sides[unitsSide].SQL = mg.Depth(sideNames[unitsSide])
+	for i := range r.Sides {
+		r.Sides[i].Diff = r.Sides[i].Node - r.Sides[i].SQL
+		r.Sides[i].Unreliable = mg.Failed(sideNames[i])
+	}
+	return &r, nil
+}
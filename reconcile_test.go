@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/thorchain/midgard/chain"
+	"gitlab.com/thorchain/midgard/internal/thornode"
+	"gitlab.com/thorchain/midgard/internal/thornode/thornodetest"
+	"gitlab.com/thorchain/midgard/internal/timeseries"
+	"gitlab.com/thorchain/midgard/internal/timeseries/timeseriestest"
+)
+
+const testPool = "BNB.BNB"
+
+// TestStore has a stake on height 1 and a swap to asset on height 3, out
+// of 4 heights. The depths are 100 RUNE, 10 asset and 50 units up to height
+// 2, and 120 RUNE, 8 asset and 50 units from height 3.
+func testStore() *timeseriestest.Store {
+	var s timeseriestest.Store
+	for height := int64(1); height <= 4; height++ {
+		s.AddBlock(height, int(height)*1000)
+	}
+	s.AddEvent("TotalRuneStakes", testPool, 1000, 100)
+	s.AddEvent("TotalAssetStakes", testPool, 1000, 10)
+	s.AddEvent("TotalStakeUnits", testPool, 1000, 50)
+	s.AddEvent("BlockDepth", testPool, 1000, 100)
+	s.AddEvent("BlockAssetDepth", testPool, 1000, 10)
+	s.AddEvent("TotalRuneSwapIn", testPool, 3000, 20)
+	s.AddEvent("TotalAssetSwapOut", testPool, 3000, 2)
+	s.AddEvent("BlockDepth", testPool, 3000, 120)
+	s.AddEvent("BlockAssetDepth", testPool, 3000, 8)
+	return &s
+}
+
+// TestNode starts a thornode stand-in with a client for it.
+func testNode(t *testing.T) (*thornodetest.Server, *thornode.Client) {
+	t.Helper()
+	srv := thornodetest.NewServer()
+	t.Cleanup(srv.Close)
+	node, err := thornode.NewClient(srv.URL, time.Second)
+	if err != nil {
+		t.Fatal("thornode client:", err)
+	}
+	node.Backoff = time.Millisecond
+	return srv, node
+}
+
+func testConfig() *Config {
+	var c Config
+	c.Reconcile.FromHeight = 1
+	c.Reconcile.ToHeight = 4
+	c.Reconcile.Step = 1
+	c.Reconcile.Workers = 2
+	return &c
+}
+
+func testPoolAt(rune, asset, units int64) thornode.Pool {
+	return thornode.Pool{Asset: testPool, BalanceRune: rune, BalanceAsset: asset, PoolUnits: units, Status: "Enabled"}
+}
+
+// Divergences are hand-made on the node side, with the diff per height,
+// per side, as the expectation.
+var divergenceTests = []struct {
+	name   string
+	states map[int64]thornode.Pool
+	diffs  [4][3]int64
+}{
+	{"in sync", map[int64]thornode.Pool{
+		1: testPoolAt(100, 10, 50),
+		3: testPoolAt(120, 8, 50),
+	}, [4][3]int64{}},
+	{"RUNE from height 3", map[int64]thornode.Pool{
+		1: testPoolAt(100, 10, 50),
+		3: testPoolAt(125, 8, 50),
+	}, [4][3]int64{{0, 0, 0}, {0, 0, 0}, {5, 0, 0}, {5, 0, 0}}},
+	{"units from height 2", map[int64]thornode.Pool{
+		1: testPoolAt(100, 10, 50),
+		2: testPoolAt(100, 10, 60),
+		3: testPoolAt(120, 8, 60),
+	}, [4][3]int64{{0, 0, 0}, {0, 0, 10}, {0, 0, 10}, {0, 0, 10}}},
+	{"asset on height 2 only", map[int64]thornode.Pool{
+		1: testPoolAt(100, 10, 50),
+		2: testPoolAt(100, 7, 50),
+		3: testPoolAt(120, 8, 50),
+	}, [4][3]int64{{0, 0, 0}, {0, -3, 0}, {0, 0, 0}, {0, 0, 0}}},
+	{"unknown to node", nil, [4][3]int64{{-100, -10, -50}, {-100, -10, -50}, {-120, -8, -50}, {-120, -8, -50}}},
+}
+
+func diffsOf(r *result) [3]int64 {
+	return [3]int64{r.Sides[runeSide].Diff, r.Sides[assetSide].Diff, r.Sides[unitsSide].Diff}
+}
+
+func TestReconcileRange(t *testing.T) {
+	for _, test := range divergenceTests {
+		srv, node := testNode(t)
+		for height, p := range test.states {
+			srv.SetPool(height, p)
+		}
+		store := testStore()
+		pools, firstSeen, err := store.Pools(context.Background())
+		if err != nil {
+			t.Fatal("pools:", err)
+		}
+
+		var got []*result
+		err = reconcileRange(context.Background(), testConfig(), store, node, pools, firstSeen, false, func(height int64, results []*result) error {
+			if len(results) != 1 {
+				t.Errorf("%s: got %d results on height %d, want 1", test.name, len(results), height)
+			}
+			got = append(got, results...)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: got error: %s", test.name, err)
+			continue
+		}
+		if len(got) != len(test.diffs) {
+			t.Errorf("%s: got %d results, want %d", test.name, len(got), len(test.diffs))
+			continue
+		}
+
+		for i, r := range got {
+			if r.Height != int64(i+1) || r.Timestamp != (i+1)*1000 {
+				t.Errorf("%s: result %d on height %d, block timestamp %d", test.name, i, r.Height, r.Timestamp)
+			}
+			if diffs := diffsOf(r); diffs != test.diffs[i] {
+				t.Errorf("%s: height %d got diffs %v, want %v", test.name, r.Height, diffs, test.diffs[i])
+			}
+			if changed := i != 0 && test.diffs[i] != test.diffs[i-1]; changed != (r.Deltas != nil) {
+				t.Errorf("%s: height %d got deltas %v with diff change %t", test.name, r.Height, r.Deltas, changed)
+			}
+		}
+		if want := []string{"outbound_events", "swap_events"}; !reflect.DeepEqual(got[2].Tables, want) {
+			t.Errorf("%s: height 3 got tables %q, want %q", test.name, got[2].Tables, want)
+		}
+	}
+}
+
+// A resumed run must agree with an uninterrupted one, deltas and tables
+// included.
+func TestReconcileRangeResume(t *testing.T) {
+	for _, test := range divergenceTests {
+		srv, node := testNode(t)
+		for height, p := range test.states {
+			srv.SetPool(height, p)
+		}
+		store := testStore()
+		pools, firstSeen, _ := store.Pools(context.Background())
+
+		want := make(map[int64]*result)
+		err := reconcileRange(context.Background(), testConfig(), store, node, pools, firstSeen, false, func(height int64, results []*result) error {
+			want[height] = results[0]
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: got error: %s", test.name, err)
+		}
+
+		// resume from a checkpoint on height 2
+		c := testConfig()
+		c.Reconcile.FromHeight = 3
+		var heights []int64
+		err = reconcileRange(context.Background(), c, store, node, pools, firstSeen, true, func(height int64, results []*result) error {
+			heights = append(heights, height)
+			r := results[0]
+			if diffsOf(r) != diffsOf(want[height]) || !reflect.DeepEqual(r.Deltas, want[height].Deltas) || !reflect.DeepEqual(r.Tables, want[height].Tables) {
+				t.Errorf("%s: height %d got diffs %v, deltas %v and tables %q; want diffs %v, deltas %v and tables %q", test.name, height,
+					diffsOf(r), r.Deltas, r.Tables, diffsOf(want[height]), want[height].Deltas, want[height].Tables)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: resume got error: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(heights, []int64{3, 4}) {
+			t.Errorf("%s: resume wrote heights %v, want [3 4]", test.name, heights)
+		}
+	}
+}
+
+// Live mode must agree with range mode, tables included.
+func TestReconcileLive(t *testing.T) {
+	for _, test := range divergenceTests {
+		srv, node := testNode(t)
+		for height, p := range test.states {
+			srv.SetPool(height, p)
+		}
+		c := testConfig()
+		c.Reconcile.ToHeight = 1 // done already
+
+		blocks := make(chan chain.Block, 4)
+		for height := int64(1); height <= 4; height++ {
+			blocks <- chain.Block{Height: height}
+		}
+		close(blocks)
+
+		var got []*result
+		err := reconcileLive(context.Background(), c, testStore(), node, blocks, func(height int64, results []*result) error {
+			got = append(got, results...)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: got error: %s", test.name, err)
+			continue
+		}
+		if len(got) != 3 {
+			t.Errorf("%s: got %d results, want 3", test.name, len(got))
+			continue
+		}
+		for _, r := range got {
+			if diffs := diffsOf(r); diffs != test.diffs[r.Height-1] {
+				t.Errorf("%s: height %d got diffs %v, want %v", test.name, r.Height, diffs, test.diffs[r.Height-1])
+			}
+		}
+		if want := []string{"outbound_events", "swap_events"}; !reflect.DeepEqual(got[1].Tables, want) {
+			t.Errorf("%s: height 3 got tables %q, want %q", test.name, got[1].Tables, want)
+		}
+		if got[2].Tables != nil {
+			t.Errorf("%s: height 4 got tables %q, want none", test.name, got[2].Tables)
+		}
+	}
+}
+
+func TestReconcileRangeNodeFailure(t *testing.T) {
+	srv, node := testNode(t)
+	srv.SetPool(1, testPoolAt(100, 10, 50))
+	node.MaxRetries = 1
+	srv.FailNext(503, 100)
+
+	store := testStore()
+	pools, firstSeen, _ := store.Pools(context.Background())
+	err := reconcileRange(context.Background(), testConfig(), store, node, pools, firstSeen, false, func(int64, []*result) error { return nil })
+	var status *thornode.StatusError
+	if !errors.As(err, &status) {
+		t.Errorf("got error %v, want a thornode status error", err)
+	}
+}
+
+func TestReconcileRangeUnknownHeight(t *testing.T) {
+	_, node := testNode(t)
+	store := testStore()
+	pools, firstSeen, _ := store.Pools(context.Background())
+
+	c := testConfig()
+	c.Reconcile.ToHeight = 5
+	err := reconcileRange(context.Background(), c, store, node, pools, firstSeen, false, func(int64, []*result) error {
+		t.Error("write without block timestamps")
+		return nil
+	})
+	if err == nil {
+		t.Error("no error for height 5 not in block_log")
+	}
+}
+
+func TestFailedComponent(t *testing.T) {
+	srv, node := testNode(t)
+	srv.SetPool(1, testPoolAt(100, 10, 50))
+	store := testStore()
+	store.Err = map[string]error{"Gas": errors.New("test failure")}
+
+	mg := newTestTotals(t, store, 2)
+	r, err := reconcilePool(context.Background(), node, testPool, 2, 2000, mg)
+	if err != nil {
+		t.Fatal("reconcile pool:", err)
+	}
+	if !r.Sides[runeSide].Unreliable || r.Sides[assetSide].Unreliable || r.Sides[unitsSide].Unreliable {
+		t.Errorf("got unreliable sides %t %t %t, want RUNE only", r.Sides[runeSide].Unreliable, r.Sides[assetSide].Unreliable, r.Sides[unitsSide].Unreliable)
+	}
+	if got := r.statusMap()["Gas"]; got != "failed" {
+		t.Errorf("got Gas status %q, want failed", got)
+	}
+
+	record := r.record()
+	if record[4] != "" || record[6] != "" {
+		t.Errorf("got RUNE SQL %q and diff %q, want blanks", record[4], record[6])
+	}
+	if record[8] != "10" || record[10] != "0" {
+		t.Errorf("got asset SQL %q and diff %q, want 10 and 0", record[8], record[10])
+	}
+
+	// beyond any tolerance when it were reliable
+	r.Sides[runeSide].Diff = 1e12
+	g := newGuard(testConfig())
+	g.check([]*result{r})
+	if g.exceeded {
+		t.Error("unreliable side exceeded tolerance")
+	}
+}
+
+// NewTestTotals returns the totals of the test pool on height.
+func newTestTotals(t *testing.T, store timeseries.Store, height int64) timeseries.Midgard {
+	t.Helper()
+	_, totals, err := timeseries.TotalsAtHeight(context.Background(), store, height, testPool)
+	if err != nil {
+		t.Fatal("totals:", err)
+	}
+	return totals[testPool]
+}
+
+func TestFirstDivergence(t *testing.T) {
+	for _, test := range divergenceTests {
+		srv, node := testNode(t)
+		for height, p := range test.states {
+			srv.SetPool(height, p)
+		}
+		p := newProber(testStore(), node)
+
+		for sideIndex, sideName := range sideNames {
+			// divergences persist in the bisect model
+			var want int64
+			for i := len(test.diffs) - 1; i >= 0 && test.diffs[i][sideIndex] != 0; i-- {
+				want = int64(i + 1)
+			}
+
+			height, r, err := p.firstDivergence(context.Background(), testPool, sideIndex, 1, 4)
+			if err != nil {
+				t.Errorf("%s %s: got error: %s", test.name, sideName, err)
+				continue
+			}
+			if height != want {
+				t.Errorf("%s %s: got height %d, want %d", test.name, sideName, height, want)
+			}
+			if (r != nil) != (want != 0) {
+				t.Errorf("%s %s: got result %v", test.name, sideName, r)
+			}
+		}
+	}
+}
+
+func TestChangePoints(t *testing.T) {
+	for _, test := range divergenceTests {
+		srv, node := testNode(t)
+		for height, p := range test.states {
+			srv.SetPool(height, p)
+		}
+		p := newProber(testStore(), node)
+
+		for sideIndex, sideName := range sideNames {
+			var want []int64
+			for i := 1; i < len(test.diffs); i++ {
+				if test.diffs[i][sideIndex] != test.diffs[i-1][sideIndex] {
+					want = append(want, int64(i+1))
+				}
+			}
+
+			var got []int64
+			err := p.changePoints(context.Background(), testPool, sideIndex, 1, 4, 2, func(height int64, prev, r *result) error {
+				got = append(got, height)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("%s %s: got error: %s", test.name, sideName, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s: got change points %v, want %v", test.name, sideName, got, want)
+			}
+		}
+	}
+}
+
+// Bisect and change point mode must not act on unreliable sides.
+func TestProbeUnreliable(t *testing.T) {
+	srv, node := testNode(t)
+	srv.SetPool(1, testPoolAt(100, 10, 50))
+	srv.SetPool(3, testPoolAt(125, 8, 50))
+	store := testStore()
+	store.Err = map[string]error{"TotalRuneSwapIn": errors.New("test failure")}
+	c := testConfig()
+	c.Reconcile.Samples = 2
+
+	p := newProber(store, node)
+	if _, _, err := p.firstDivergence(context.Background(), testPool, runeSide, 1, 4); !errors.Is(err, errUnreliable) {
+		t.Errorf("first RUNE divergence got error %v, want %v", err, errUnreliable)
+	}
+	if height, _, err := p.firstDivergence(context.Background(), testPool, assetSide, 1, 4); err != nil || height != 0 {
+		t.Errorf("first asset divergence got height %d, error %v, want none", height, err)
+	}
+
+	for mode, run := range map[string]func(context.Context, *Config, timeseries.Store, *thornode.Client, []string, io.Writer) error{
+		"bisect":        bisect,
+		"change points": reportChangePoints,
+	} {
+		var out strings.Builder
+		if err := run(context.Background(), c, store, node, []string{testPool}, &out); err != nil {
+			t.Errorf("%s got error: %s", mode, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%s got output %q, want none", mode, out.String())
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,15 +10,16 @@ import (
 	"gitlab.com/thorchain/midgard/chain"
 	"gitlab.com/thorchain/midgard/chain/notinchain"
 	"gitlab.com/thorchain/midgard/internal/api"
+	"gitlab.com/thorchain/midgard/internal/thornode"
 	"gitlab.com/thorchain/midgard/internal/timeseries"
-	"gitlab.com/thorchain/midgard/internal/timeseries/stat"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"regexp"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 type Duration time.Duration
@@ -60,6 +61,9 @@ type Config struct {
 	ShutdownTimeout Duration `json:"shutdown_timeout"`
 	ReadTimeout     Duration `json:"read_timeout"`
 	WriteTimeout    Duration `json:"write_timeout"`
+	// HTTPServer enables the results API and the metrics in range mode.
+	// Serve and live mode run the HTTP server regardless.
+	HTTPServer bool `json:"http_server"`
 
 	TimeScale struct {
 		Host     string `json:"host"`
@@ -75,15 +79,56 @@ type Config struct {
 		NodeURL          string   `json:"node_url"`
 		ReadTimeout      Duration `json:"read_timeout"`
 		LastChainBackoff Duration `json:"last_chain_backoff"`
+		// NodeCache is a directory for node responses, reused across runs.
+		NodeCache string `json:"node_cache"`
+		// Offline serves node responses from NodeCache only.
+		Offline bool `json:"offline"`
+		// Network is either "mainnet", "testnet" or "chaosnet". The
+		// RUNE asset is detected from the swaps when neither Network
+		// nor RuneAsset is set.
+		Network string `json:"network"`
+		// RuneAsset overrides the RUNE identifier of the network.
+		RuneAsset string `json:"rune_asset"`
 	} `json:"thorchain"`
-}
 
-type poolData struct {
-	BalanceRune  string	 `json:"balance_rune"`
-	BalanceAsset string 	 `json:"balance_asset"`
-	Asset        string  `json:"asset"`
-	PoolUnits    string	 `json:"pool_units"`
-	Status       string	 `json:"status"`
+	Reconcile struct {
+		// Heights are inclusive. Zero ToHeight means the last block.
+		FromHeight int64    `json:"from_height"`
+		ToHeight   int64    `json:"to_height"`
+		Step       int64    `json:"step"`
+		Pools      []string `json:"pools"`
+		// Output is the default CSV sink and checkpoint location.
+		Output string `json:"output"`
+		// Workers is the number of heights reconciled concurrently.
+		Workers int `json:"workers"`
+		// Mode is either "range" (the default), "live", "bisect",
+		// "changepoints" or "serve". Live mode follows the blockchain
+		// once the range up to the last block is done. Live and serve
+		// mode run the HTTP server with the results API and the
+		// metrics.
+		Mode string `json:"mode"`
+		// Samples is the number of intervals in the first pass of
+		// change point detection.
+		Samples int `json:"samples"`
+		// Tolerances per pool and per side, with "*" as a wildcard
+		// for either. The default is zero tolerance.
+		Tolerances map[string]map[string]Tolerance `json:"tolerances"`
+		// Sinks receive the results of range and live mode.
+		Sinks []SinkConfig `json:"sinks"`
+		// Checkpoint is the file with the progress of range and live
+		// mode.
+		Checkpoint string `json:"checkpoint"`
+		// Formula replaces the default depth formula when set. The
+		// component order defines the CSV columns.
+		Formula timeseries.Formula `json:"formula"`
+	} `json:"reconcile"`
+
+	Alert struct {
+		// WebhookURL receives a JSON POST for each pool and side
+		// which exceeds its tolerance.
+		WebhookURL string   `json:"webhook_url"`
+		Timeout    Duration `json:"timeout"`
+	} `json:"alert"`
 }
 
 func main(){
@@ -97,97 +142,143 @@ func main(){
 	default:
 		log.Fatal("one optional configuration file argument only—no flags")
 	}
-	SetupDatabase(&c)
-	blocks := SetupBlockchain(&c)
-	log.Print(blocks)
 
-	file, err := os.Create("newblocksresults.csv")
-	checkError("Cannot create file", err)
-	defer file.Close()
+	// The first signal stops the work in progress gracefully.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := awaitSignal()
+	go func() {
+		log.Print("shutdown on signal ", <-signals)
+		cancel()
+		log.Fatal("exit on signal ", <-signals)
+	}()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	store := SetupDatabase(&c)
+	SetupNetwork(ctx, &c, store)
+	thorNode := SetupNode(&c)
+
+	// live mode catches up to the last block first
+	var blocks <-chan chain.Block
+	if c.Reconcile.Mode == "live" {
+		blocks = SetupBlockchain(&c, store)
+		if c.Reconcile.ToHeight != 0 {
+			log.Printf("reconcile to height %d ignored in live mode", c.Reconcile.ToHeight)
+			c.Reconcile.ToHeight = 0
+		}
+	}
 
-	lastBlockHeight, _, _, _ := timeseries.Setup()
+	lastBlockHeight, _, _, _ := timeseries.Setup(store)
+	observeLastBlock(lastBlockHeight)
 
 	log.Print(int(lastBlockHeight))
-
-	for offset := 67130; offset <= int(lastBlockHeight); offset++ {
-		log.Print(offset)
-		pool := "BNB.BNB"
-		s := strconv.Itoa(offset)
-		blockTimeStamp, err := timeseries.FetchTimestamp(s)
-		if err != nil{
-			log.Print(err)
+	SetupReconcile(&c, lastBlockHeight)
+
+	// the results API and the metrics run with the long-lived modes only,
+	// unless enabled explicitly
+	switch c.Reconcile.Mode {
+	case "serve":
+		shutdown := startHTTPServer(&c, store.DB, true)
+		<-ctx.Done()
+		shutdown()
+		return
+	case "live":
+		shutdown := startHTTPServer(&c, store.DB, true)
+		defer shutdown()
+	case "", "range":
+		if c.HTTPServer {
+			// no reason to abort a batch run
+			shutdown := startHTTPServer(&c, store.DB, false)
+			defer shutdown()
 		}
-		log.Print(blockTimeStamp)
-		BalanceRune, _, _, _, _ := CallAPI(s)
-		TotalRuneStakes, _ := timeseries.GetTotalRuneStakes(pool,blockTimeStamp)
-		TotalRunUnstakes, _ := timeseries.GetTotalRunUnstakes(pool,blockTimeStamp)
-		TotalRuneSwapIn, _ := timeseries.GetTotalRuneSwapIn(pool, blockTimeStamp)
-		TotalRuneSwapOut, _ := timeseries.GetTotalRuneSwapOut(pool, blockTimeStamp)
-		//Fees, _ := timeseries.GetFees(pool, blockTimeStamp)
-		PoolDeductRefunds, _ := timeseries.GetPoolDeductRefunds(pool,
-			blockTimeStamp)
-		RuneFeesSwaps, _ := timeseries.GetRuneFeesSwaps(pool, blockTimeStamp)
-		PoolDeductSwaps, _ := timeseries.GetPoolDeductSwaps(pool, blockTimeStamp)
-		RuneFeeUnstakes, _ := timeseries.GetRuneFeeUnstakes(pool, blockTimeStamp)
-		PoolDeductUnstakes, _ := timeseries.GetPoolDeductUnstakes(pool, blockTimeStamp)
-		Adds, _ := timeseries.GetAdds(pool, blockTimeStamp)
-		Rewards, _ := timeseries.GetRewards(pool, blockTimeStamp)
-		//Errata, _ := timeseries.GetErrata(pool,blockTimeStamp)
-		Gas, _ := timeseries.GetGas(pool, blockTimeStamp)
-		BlockDepth, _ := timeseries.GetBlockDepth(pool, blockTimeStamp)
-
-		sqlDepth := TotalRuneStakes + TotalRuneSwapIn + Adds + Rewards + Gas
-		lessDeductions := sqlDepth - (TotalRunUnstakes  + TotalRuneSwapOut + RuneFeesSwaps + PoolDeductSwaps + PoolDeductUnstakes + RuneFeeUnstakes + PoolDeductRefunds)
-
-		sqlDeepth := strconv.Itoa(int(lessDeductions))
-		log.Print("written to csv")
-		log.Print(TotalRuneStakes)
-		IntBalRune, err := strconv.Atoi(BalanceRune)
-		DiffInDepths :=  IntBalRune - int(lessDeductions)
-
-		var csvData = [][]string{
-			{s, strconv.Itoa(blockTimeStamp), BalanceRune, sqlDeepth, strconv.Itoa(int(BlockDepth)), strconv.Itoa(DiffInDepths)},
+	}
+
+	pools, firstSeen, err := store.Pools(ctx)
+	checkError("Cannot list pools", err)
+	pools, firstSeen = selectPools(c.Reconcile.Pools, pools, firstSeen)
+	log.Printf("reconcile %d pools: %s", len(pools), strings.Join(pools, ", "))
+
+	switch c.Reconcile.Mode {
+	case "", "range", "live":
+		exceeded := reconcileToOutput(ctx, &c, store, store.DB, thorNode, pools, firstSeen, blocks)
+		if ctx.Err() != nil {
+			// an incomplete run is no verdict on divergence
+			log.Print("exit on interrupted reconciliation")
+			os.Exit(1)
 		}
-		err = writer.WriteAll(csvData) // returns error
-		if err != nil {
-			fmt.Println("An error encountered ::", err)
+		if exceeded {
+			log.Print("exit on divergence beyond tolerance")
+			os.Exit(2)
 		}
+	case "bisect":
+		err = bisect(ctx, &c, store, thorNode, pools, os.Stdout)
+		checkError("Bisect failed: ", err)
+	case "changepoints":
+		err = reportChangePoints(ctx, &c, store, thorNode, pools, os.Stdout)
+		checkError("Change point detection failed: ", err)
+	default:
+		log.Fatalf("exit on unknown reconcile mode %q", c.Reconcile.Mode)
 	}
 }
 
-func checkError(message string, err error) {
-	if err != nil {
-		log.Fatal(message, err)
+// ReconcileToOutput runs the configured height range into the sinks, with
+// resume from the last checkpoint, if any. Blocks from the chain, if any, are
+// reconciled thereafter. The return is true when any of the results exceeded
+// its tolerance. Cancellation of ctx ends the run with the sinks flushed up
+// to the last complete height, which is also the checkpoint. The database, if
+// any, is for the postgres sinks.
+func reconcileToOutput(ctx context.Context, c *Config, store timeseries.Store, db *sql.DB, node *thornode.Client, pools []string, firstSeen []int, blocks <-chan chain.Block) (exceeded bool) {
+	out, err := openSinks(c, db)
+	checkError("Cannot open sinks", err)
+	defer out.Close()
+
+	g := newGuard(c)
+	write := func(height int64, results []*result) error {
+		g.check(results)
+		if err := out.write(height, results); err != nil {
+			return err
+		}
+		observeHeight(height, results)
+		return nil
 	}
-}
-
 
-func CallAPI(offset string)(BalanceRune string, BalanceAsset string,
-	Asset string, PoolUnits string, Status string ){
-	resp, err := http.Get( "http://18.159.173.48:1317/thorchain/pool/bnb." +
-		"bnb?height="+ offset)
-
-	// check for response error
-	if err != nil {
-		log.Fatal( err )
+	if c.Reconcile.FromHeight > c.Reconcile.ToHeight {
+		log.Printf("reconcile up to height %d already done according to %q", c.Reconcile.ToHeight, c.Reconcile.Checkpoint)
+	} else {
+		log.Print("reconcile from height ", c.Reconcile.FromHeight)
+		err = reconcileRange(ctx, c, store, node, pools, firstSeen, out.resumed, write)
+		if ctx.Err() != nil {
+			log.Printf("reconcile interrupted; resume from %q", c.Reconcile.Checkpoint)
+			return g.exceeded
+		}
+		checkError("Reconcile failed: ", err)
 	}
-	// read response data
-	data, _ := ioutil.ReadAll( resp.Body )
-
-	res := poolData{}
-	bodyString := string(data)
 
-	json.Unmarshal([]byte(bodyString), &res)
-	// close response body
-	defer resp.Body.Close()
+	if blocks != nil {
+		log.Print("reconcile live from height ", c.Reconcile.ToHeight+1)
+		err = reconcileLive(ctx, c, store, node, blocks, write)
+		if ctx.Err() != nil {
+			log.Printf("live reconcile interrupted; resume from %q", c.Reconcile.Checkpoint)
+			return g.exceeded
+		}
+		checkError("Live reconcile failed: ", err)
+	}
+	return g.exceeded
+}
 
-	return res.BalanceRune, res.BalanceAsset, res.Asset, res.PoolUnits, res.Status
+// AwaitSignal notifies on the first SIGINT or SIGTERM.
+func awaitSignal() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	return signals
+}
 
+func checkError(message string, err error) {
+	if err != nil {
+		log.Fatal(message, err)
+	}
 }
 
+
 func MustLoadConfigFile(path string) *Config {
 	f, err := os.Open(path)
 	if err != nil {
@@ -207,18 +298,162 @@ func MustLoadConfigFile(path string) *Config {
 	return &c
 }
 
-func SetupDatabase(c *Config) {
+// SetupDatabase instantiates the PostgreSQL client.
+func SetupDatabase(c *Config) *timeseries.PostgresStore {
 	db, err := sql.Open("pgx", fmt.Sprintf("user=%s dbname=%s sslmode=%s password=%s host=%s port=%d", c.TimeScale.UserName, c.TimeScale.Database, c.TimeScale.Sslmode, c.TimeScale.Password, c.TimeScale.Host, c.TimeScale.Port))
 	if err != nil {
 		log.Fatal("exit on PostgreSQL client instantiation: ", err)
 	}
 
-	stat.DBQuery = db.QueryContext
-	timeseries.DBExec = db.Exec
-	timeseries.DBQuery = db.QueryContext
+	return &timeseries.PostgresStore{DB: db}
 }
-// SetupBlockchain launches the synchronisation routine.
-func SetupBlockchain(c *Config) <-chan chain.Block {
+// SetupReconcile normalizes & validates the reconcile configuration.
+func SetupReconcile(c *Config, lastBlockHeight int64) {
+	if c.Reconcile.FromHeight <= 0 {
+		c.Reconcile.FromHeight = 1
+		log.Printf("default reconcile from height to %d", c.Reconcile.FromHeight)
+	}
+	if c.Reconcile.ToHeight <= 0 {
+		c.Reconcile.ToHeight = lastBlockHeight
+		log.Printf("default reconcile to height to last block %d", c.Reconcile.ToHeight)
+	}
+	if c.Reconcile.ToHeight > lastBlockHeight {
+		log.Printf("reconcile to height %d beyond last block; clamped to %d", c.Reconcile.ToHeight, lastBlockHeight)
+		c.Reconcile.ToHeight = lastBlockHeight
+	}
+	if c.Reconcile.FromHeight > c.Reconcile.ToHeight {
+		log.Fatalf("exit on reconcile from height %d beyond to height %d", c.Reconcile.FromHeight, c.Reconcile.ToHeight)
+	}
+	if c.Reconcile.Step <= 0 {
+		c.Reconcile.Step = 1
+	}
+	if c.Reconcile.Workers <= 0 {
+		c.Reconcile.Workers = 4
+		log.Printf("default reconcile workers to %d", c.Reconcile.Workers)
+	}
+	if len(c.Reconcile.Formula) != 0 {
+		if err := timeseries.SetFormula(c.Reconcile.Formula); err != nil {
+			log.Fatal("exit on malformed reconcile formula: ", err)
+		}
+		log.Printf("reconcile formula with %d components from configuration", len(c.Reconcile.Formula))
+	}
+	for pool, sides := range c.Reconcile.Tolerances {
+		for sideName := range sides {
+			if sideName != "*" && sideIndex(sideName) < 0 {
+				log.Fatalf("exit on unknown side %q in tolerance of pool %q", sideName, pool)
+			}
+		}
+	}
+	if c.Alert.WebhookURL != "" {
+		if _, err := url.Parse(c.Alert.WebhookURL); err != nil {
+			log.Fatal("exit on malformed alert webhook URL: ", err)
+		}
+	}
+	if c.Reconcile.Samples <= 0 {
+		c.Reconcile.Samples = 64
+	}
+	if c.Reconcile.Output == "" {
+		c.Reconcile.Output = "newblocksresults.csv"
+	}
+	if len(c.Reconcile.Sinks) == 0 {
+		c.Reconcile.Sinks = []SinkConfig{{Type: "csv", Path: c.Reconcile.Output}}
+		log.Printf("default reconcile sink to CSV %q", c.Reconcile.Output)
+	}
+	for i := range c.Reconcile.Sinks {
+		sc := &c.Reconcile.Sinks[i]
+		switch sc.Type {
+		case "csv", "jsonl":
+			if sc.Path == "" {
+				log.Fatalf("exit on %s sink without path", sc.Type)
+			}
+		case "stdout":
+			if sc.Format != "" && sc.Format != "csv" && sc.Format != "jsonl" {
+				log.Fatalf("exit on unknown stdout sink format %q", sc.Format)
+			}
+		case "postgres":
+			if sc.Table == "" {
+				sc.Table = "depth_reconciliation"
+			}
+			if !sqlNamePattern.MatchString(sc.Table) {
+				log.Fatalf("exit on malformed postgres sink table %q", sc.Table)
+			}
+		default:
+			log.Fatalf("exit on unknown sink type %q", sc.Type)
+		}
+	}
+	if c.Reconcile.Checkpoint == "" {
+		c.Reconcile.Checkpoint = c.Reconcile.Output + ".checkpoint"
+		log.Printf("default reconcile checkpoint to %q", c.Reconcile.Checkpoint)
+	}
+}
+
+// SQLNamePattern matches a (schema qualified) table name.
+var sqlNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+// SelectPools filters the known pools on the configured ones. An empty
+// selection means all pools.
+func selectPools(selection, pools []string, firstSeen []int) ([]string, []int) {
+	if len(selection) == 0 {
+		return pools, firstSeen
+	}
+
+	var selPools []string
+	var selFirstSeen []int
+	for _, want := range selection {
+		found := false
+		for i, pool := range pools {
+			if pool == want {
+				selPools = append(selPools, pool)
+				selFirstSeen = append(selFirstSeen, firstSeen[i])
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Fatalf("exit on unknown reconcile pool %q", want)
+		}
+	}
+	return selPools, selFirstSeen
+}
+
+// RuneAssets has the RUNE identifier per network.
+var runeAssets = map[string]string{
+	"mainnet":  "BNB.RUNE-B1A",
+	"testnet":  "BNB.RUNE-67C",
+	"chaosnet": "THOR.RUNE",
+}
+
+// SetupNetwork resolves the RUNE asset for the queries of store.
+func SetupNetwork(ctx context.Context, c *Config, store *timeseries.PostgresStore) {
+	switch {
+	case c.ThorChain.RuneAsset != "":
+		log.Printf("RUNE asset is set to %q", c.ThorChain.RuneAsset)
+	case c.ThorChain.Network != "":
+		asset, ok := runeAssets[c.ThorChain.Network]
+		if !ok {
+			log.Fatalf("exit on unknown network %q", c.ThorChain.Network)
+		}
+		c.ThorChain.RuneAsset = asset
+		log.Printf("RUNE asset of %s is %q", c.ThorChain.Network, asset)
+	default:
+		asset, err := store.DetectRuneAsset(ctx)
+		if err != nil {
+			log.Fatal("exit on RUNE asset detection: ", err)
+		}
+		if asset == "" {
+			asset = runeAssets["mainnet"]
+			log.Printf("no swaps to detect the RUNE asset from; default to %q", asset)
+		} else {
+			log.Printf("RUNE asset detected as %q", asset)
+		}
+		c.ThorChain.RuneAsset = asset
+	}
+	store.RuneAsset = c.ThorChain.RuneAsset
+}
+
+// SetupNode instantiates the THOR node REST client, which serves the pool
+// state per height.
+func SetupNode(c *Config) *thornode.Client {
 	// normalize & validate configuration
 	if c.ThorChain.NodeURL == "" {
 		c.ThorChain.NodeURL = "http://localhost:1317/thorchain"
@@ -226,9 +461,32 @@ func SetupBlockchain(c *Config) <-chan chain.Block {
 	} else {
 		log.Printf("THOR node REST URL is set to %q", c.ThorChain.NodeURL)
 	}
-	if _, err := url.Parse(c.ThorChain.NodeURL); err != nil {
-		log.Fatal("exit on malformed THOR node REST URL: ", err)
+
+	thorNode, err := thornode.NewClient(c.ThorChain.NodeURL, c.ThorChain.ReadTimeout.WithDefault(2*time.Second))
+	if err != nil {
+		log.Fatal("exit on THOR node REST client instantiation: ", err)
+	}
+
+	if c.ThorChain.NodeCache != "" {
+		log.Printf("THOR node responses cached in %q", c.ThorChain.NodeCache)
+	}
+	if c.ThorChain.Offline {
+		if c.ThorChain.NodeCache == "" {
+			log.Fatal("exit on offline mode without a THOR node cache")
+		}
+		if c.Reconcile.Mode == "live" {
+			log.Fatal("exit on offline mode with live reconciliation")
+		}
+		log.Print("THOR node offline; responses from cache only")
 	}
+	thorNode.CacheDir = c.ThorChain.NodeCache
+	thorNode.Offline = c.ThorChain.Offline
+	return thorNode
+}
+
+// SetupBlockchain launches the synchronisation routine.
+func SetupBlockchain(c *Config, store timeseries.Store) <-chan chain.Block {
+	// normalize & validate configuration
 	notinchain.BaseURL = c.ThorChain.NodeURL
 
 	if c.ThorChain.URL == "" {
@@ -250,7 +508,7 @@ func SetupBlockchain(c *Config) <-chan chain.Block {
 	}
 
 	// fetch current position (from commit log)
-	offset, _, _, err := timeseries.Setup()
+	offset, _, _, err := timeseries.Setup(store)
 	if err != nil {
 		// no point in running without a database
 		log.Fatal("exit on RDB unavailable: ", err)
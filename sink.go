@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"gitlab.com/thorchain/midgard/internal/timeseries"
+)
+
+// SinkConfig selects a result destination.
+type SinkConfig struct {
+	// Type is either "csv", "jsonl", "stdout" or "postgres".
+	Type string `json:"type"`
+	// Path is the file for "csv" and "jsonl".
+	Path string `json:"path"`
+	// Format is either "csv" (the default) or "jsonl" for "stdout".
+	Format string `json:"format"`
+	// Table is the destination for "postgres".
+	Table string `json:"table"`
+}
+
+// Sink is a result destination.
+type sink interface {
+	// Write passes the results of a height, in height order.
+	write(results []*result) error
+	// Flush persists all writes for a checkpoint.
+	flush() error
+	// Offset returns the file size after flush, with an empty path for
+	// sinks without a file.
+	offset() (path string, size int64, err error)
+	Close() error
+}
+
+// Sinks distributes results to each sink, with a checkpoint per height.
+type sinks struct {
+	all            []sink
+	checkpointPath string
+	// window of the run, as in the checkpoint
+	fromHeight, toHeight, step int64
+	// resumed is set when FromHeight continues from a checkpoint
+	resumed bool
+}
+
+// OpenSinks opens the configured sinks for a (resumed) run. File sinks are
+// truncated to the last checkpoint, if any, and FromHeight continues from
+// there. A checkpoint of another window is refused. The database is for
+// postgres sinks.
+func openSinks(c *Config, db *sql.DB) (*sinks, error) {
+	cp, err := loadCheckpoint(c.Reconcile.Checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	s := &sinks{
+		checkpointPath: c.Reconcile.Checkpoint,
+		fromHeight:     c.Reconcile.FromHeight,
+		toHeight:       c.Reconcile.ToHeight,
+		step:           c.Reconcile.Step,
+	}
+	if cp != nil {
+		if err := cp.resumes(c); err != nil {
+			return nil, fmt.Errorf("%w; remove %q to start over", err, c.Reconcile.Checkpoint)
+		}
+		c.Reconcile.FromHeight = cp.Height + c.Reconcile.Step
+		s.resumed = true
+	}
+
+	for _, sc := range c.Reconcile.Sinks {
+		one, err := openSink(sc, cp, db)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("%s sink: %w", sc.Type, err)
+		}
+		s.all = append(s.all, one)
+	}
+	return s, nil
+}
+
+func openSink(sc SinkConfig, cp *checkpoint, db *sql.DB) (sink, error) {
+	switch sc.Type {
+	case "csv":
+		file, isNew, err := openSinkFile(sc.Path, cp)
+		if err != nil {
+			return nil, err
+		}
+		return newCSVSink(file, isNew)
+	case "jsonl":
+		file, _, err := openSinkFile(sc.Path, cp)
+		if err != nil {
+			return nil, err
+		}
+		return newJSONLSink(file), nil
+	case "stdout":
+		if sc.Format == "jsonl" {
+			return newJSONLSink(os.Stdout), nil
+		}
+		return newCSVSink(os.Stdout, true)
+	case "postgres":
+		if db == nil {
+			return nil, errors.New("no database")
+		}
+		return newPostgresSink(db, sc.Table)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+	}
+}
+
+// OpenSinkFile opens path for a (resumed) run. The file is truncated to its
+// offset in the checkpoint, if any.
+func openSinkFile(path string, cp *checkpoint) (file *os.File, isNew bool, err error) {
+	if cp == nil {
+		file, err = os.Create(path)
+		return file, true, err
+	}
+
+	offset, ok := cp.Offsets[path]
+	if !ok {
+		log.Printf("sink %q not in checkpoint; starts from scratch", path)
+	}
+	file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	return file, offset == 0, nil
+}
+
+func (s *sinks) write(height int64, results []*result) error {
+	cp := checkpoint{Height: height, FromHeight: s.fromHeight, ToHeight: s.toHeight, Step: s.step, Offsets: make(map[string]int64)}
+	for _, one := range s.all {
+		if err := one.write(results); err != nil {
+			return err
+		}
+		if err := one.flush(); err != nil {
+			return err
+		}
+		path, size, err := one.offset()
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			cp.Offsets[path] = size
+		}
+	}
+	return cp.save(s.checkpointPath)
+}
+
+// Close closes all sinks.
+func (s *sinks) Close() error {
+	var err error
+	for _, one := range s.all {
+		if closeErr := one.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// FileOffset gets the write position of file, with an empty path for the
+// standard output.
+func fileOffset(file *os.File) (path string, size int64, err error) {
+	if file == os.Stdout {
+		return "", 0, nil
+	}
+	size, err = file.Seek(0, io.SeekCurrent)
+	return file.Name(), size, err
+}
+
+func closeFile(file *os.File) error {
+	if file == os.Stdout {
+		return nil
+	}
+	return file.Close()
+}
+
+// CSVHeader returns the column names of result.record.
+func csvHeader() []string {
+	header := []string{"pool", "height", "timestamp"}
+	for _, sideName := range sideNames {
+		header = append(header, sideName+"_node", sideName+"_sql")
+		if sideName != "units" {
+			header = append(header, sideName+"_block")
+		}
+		header = append(header, sideName+"_diff")
+	}
+	for _, name := range timeseries.ComponentNames() {
+		header = append(header, name+"_delta")
+	}
+	return append(header, "tables", "status")
+}
+
+type csvSink struct {
+	*csv.Writer
+	file *os.File
+}
+
+func newCSVSink(file *os.File, withHeader bool) (*csvSink, error) {
+	s := &csvSink{Writer: csv.NewWriter(file), file: file}
+	if withHeader {
+		if err := s.Write(csvHeader()); err != nil {
+			closeFile(file)
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *csvSink) write(results []*result) error {
+	for _, r := range results {
+		if err := s.Write(r.record()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *csvSink) flush() error {
+	s.Flush()
+	return s.Error()
+}
+
+func (s *csvSink) offset() (path string, size int64, err error) {
+	return fileOffset(s.file)
+}
+
+func (s *csvSink) Close() error {
+	s.Flush()
+	return closeFile(s.file)
+}
+
+// ResultJSON is the JSON Lines representation of a result.
+type resultJSON struct {
+	Pool      string           `json:"pool"`
+	Height    int64            `json:"height"`
+	Timestamp int              `json:"timestamp"`
+	Rune      *side            `json:"rune"`
+	Asset     *side            `json:"asset"`
+	Units     *side            `json:"units"`
+	Deltas    map[string]int64 `json:"deltas,omitempty"`
+	Tables    []string         `json:"tables,omitempty"`
+	// Components are omitted in JSON Lines.
+	Components map[string]int64 `json:"components,omitempty"`
+	// Status has each component which is missing, zero or failed.
+	Status map[string]string `json:"status,omitempty"`
+}
+
+type jsonlSink struct {
+	buf  *bufio.Writer
+	enc  *json.Encoder
+	file *os.File
+}
+
+func newJSONLSink(file *os.File) *jsonlSink {
+	buf := bufio.NewWriter(file)
+	return &jsonlSink{buf: buf, enc: json.NewEncoder(buf), file: file}
+}
+
+func (s *jsonlSink) write(results []*result) error {
+	for _, r := range results {
+		v := resultJSON{
+			Pool:      r.Pool,
+			Height:    r.Height,
+			Timestamp: r.Timestamp,
+			Rune:      &r.Sides[runeSide],
+			Asset:     &r.Sides[assetSide],
+			Units:     &r.Sides[unitsSide],
+			Tables:    r.Tables,
+			Status:    r.statusMap(),
+		}
+		if r.Deltas != nil {
+			v.Deltas = make(map[string]int64, len(r.Deltas))
+			for i, name := range timeseries.ComponentNames() {
+				v.Deltas[name] = r.Deltas[i]
+			}
+		}
+		if err := s.enc.Encode(&v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonlSink) flush() error {
+	return s.buf.Flush()
+}
+
+func (s *jsonlSink) offset() (path string, size int64, err error) {
+	return fileOffset(s.file)
+}
+
+func (s *jsonlSink) Close() error {
+	s.buf.Flush()
+	return closeFile(s.file)
+}
+
+// PostgresSink upserts into a hypertable in the Timescale database, keyed by
+// (pool, height).
+type postgresSink struct {
+	db    *sql.DB
+	table string
+}
+
+// PostgresColumns has the number of columns in a postgresSink table.
+const postgresColumns = 18
+
+func newPostgresSink(db *sql.DB, table string) (*postgresSink, error) {
+	ddl := []string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (
+			pool		VARCHAR(60) NOT NULL,
+			height		BIGINT NOT NULL,
+			block_timestamp	BIGINT NOT NULL,
+			rune_node	BIGINT NOT NULL,
+			rune_sql	BIGINT,
+			rune_block	BIGINT NOT NULL,
+			rune_diff	BIGINT,
+			asset_node	BIGINT NOT NULL,
+			asset_sql	BIGINT,
+			asset_block	BIGINT NOT NULL,
+			asset_diff	BIGINT,
+			units_node	BIGINT NOT NULL,
+			units_sql	BIGINT,
+			units_diff	BIGINT,
+			components	JSONB NOT NULL,
+			deltas		JSONB,
+			tables		TEXT[],
+			status		JSONB,
+			PRIMARY KEY (pool, height)
+		)`,
+		`ALTER TABLE ` + table + ` ADD COLUMN IF NOT EXISTS status JSONB`,
+		// NULL for unreliable sides
+		`ALTER TABLE ` + table + ` ALTER COLUMN rune_sql DROP NOT NULL, ALTER COLUMN rune_diff DROP NOT NULL,
+			ALTER COLUMN asset_sql DROP NOT NULL, ALTER COLUMN asset_diff DROP NOT NULL,
+			ALTER COLUMN units_sql DROP NOT NULL, ALTER COLUMN units_diff DROP NOT NULL`,
+		`SELECT create_hypertable('` + table + `', 'height', chunk_time_interval => 1000000, if_not_exists => TRUE)`,
+	}
+	for _, q := range ddl {
+		if _, err := db.Exec(q); err != nil {
+			return nil, fmt.Errorf("setup table %s: %w", table, err)
+		}
+	}
+	return &postgresSink{db: db, table: table}, nil
+}
+
+// ComponentsJSON returns the component values in a JSON object.
+func componentsJSON(values []int64) ([]byte, error) {
+	m := make(map[string]int64, len(values))
+	for i, name := range timeseries.ComponentNames() {
+		m[name] = values[i]
+	}
+	return json.Marshal(m)
+}
+
+func (s *postgresSink) write(results []*result) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	var q strings.Builder
+	q.WriteString("INSERT INTO " + s.table + " (pool, height, block_timestamp, rune_node, rune_sql, rune_block, rune_diff, asset_node, asset_sql, asset_block, asset_diff, units_node, units_sql, units_diff, components, deltas, tables, status) VALUES ")
+	args := make([]interface{}, 0, postgresColumns*len(results))
+	for i, r := range results {
+		if i != 0 {
+			q.WriteString(", ")
+		}
+		q.WriteByte('(')
+		for j := 0; j < postgresColumns; j++ {
+			if j != 0 {
+				q.WriteString(", ")
+			}
+			q.WriteString("$" + strconv.Itoa(len(args)+j+1))
+		}
+		q.WriteByte(')')
+
+		components, err := componentsJSON(r.Totals.Values())
+		if err != nil {
+			return err
+		}
+		var deltas interface{} // NULL when the diff did not change
+		if r.Deltas != nil {
+			bytes, err := componentsJSON(r.Deltas)
+			if err != nil {
+				return err
+			}
+			deltas = string(bytes)
+		}
+
+		status, err := json.Marshal(r.statusMap())
+		if err != nil {
+			return err
+		}
+
+		rs, as, us := &r.Sides[runeSide], &r.Sides[assetSide], &r.Sides[unitsSide]
+		args = append(args, r.Pool, r.Height, r.Timestamp,
+			rs.Node, rs.sqlArg(rs.SQL), rs.Block, rs.sqlArg(rs.Diff),
+			as.Node, as.sqlArg(as.SQL), as.Block, as.sqlArg(as.Diff),
+			us.Node, us.sqlArg(us.SQL), us.sqlArg(us.Diff),
+			string(components), deltas, r.Tables, string(status))
+	}
+	q.WriteString(` ON CONFLICT (pool, height) DO UPDATE SET
+		block_timestamp = EXCLUDED.block_timestamp,
+		rune_node = EXCLUDED.rune_node, rune_sql = EXCLUDED.rune_sql, rune_block = EXCLUDED.rune_block, rune_diff = EXCLUDED.rune_diff,
+		asset_node = EXCLUDED.asset_node, asset_sql = EXCLUDED.asset_sql, asset_block = EXCLUDED.asset_block, asset_diff = EXCLUDED.asset_diff,
+		units_node = EXCLUDED.units_node, units_sql = EXCLUDED.units_sql, units_diff = EXCLUDED.units_diff,
+		components = EXCLUDED.components, deltas = EXCLUDED.deltas, tables = EXCLUDED.tables, status = EXCLUDED.status`)
+
+	if _, err := s.db.Exec(q.String(), args...); err != nil {
+		return fmt.Errorf("upsert into %s: %w", s.table, err)
+	}
+	return nil
+}
+
+// SQLArg returns the query argument of v, which is derived from SQL, with
+// NULL for unreliable sides.
+func (s *side) sqlArg(v int64) interface{} {
+	if s.Unreliable {
+		return nil
+	}
+	return v
+}
+
+func (s *postgresSink) flush() error { return nil }
+
+func (s *postgresSink) offset() (path string, size int64, err error) { return "", 0, nil }
+
+func (s *postgresSink) Close() error { return nil }
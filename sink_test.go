@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestResults reconciles the test store against a node which diverges on
+// the RUNE side from height 3, with the results per height.
+func testResults(t *testing.T) [][]*result {
+	t.Helper()
+	srv, node := testNode(t)
+	srv.SetPool(1, testPoolAt(100, 10, 50))
+	srv.SetPool(3, testPoolAt(125, 8, 50))
+	store := testStore()
+	pools, firstSeen, _ := store.Pools(context.Background())
+
+	var all [][]*result
+	err := reconcileRange(context.Background(), testConfig(), store, node, pools, firstSeen, false, func(height int64, results []*result) error {
+		all = append(all, results)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("reconcile:", err)
+	}
+	return all
+}
+
+func writeSink(t *testing.T, s sink, all [][]*result) {
+	t.Helper()
+	for _, results := range all {
+		if err := s.write(results); err != nil {
+			t.Fatal("sink write:", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("sink close:", err)
+	}
+}
+
+func TestCSVSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.csv")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newCSVSink(file, true)
+	if err != nil {
+		t.Fatal("CSV sink:", err)
+	}
+	writeSink(t, s, testResults(t))
+
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal("malformed CSV:", err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("got %d records, want a header and 4 rows", len(records))
+	}
+	if !reflect.DeepEqual(records[0], csvHeader()) {
+		t.Errorf("got header %q, want %q", records[0], csvHeader())
+	}
+
+	tests := []struct {
+		row    int
+		column string
+		want   string
+	}{
+		{1, "height", "1"},
+		{1, "rune_node", "100"},
+		{1, "rune_sql", "100"},
+		{1, "rune_block", "100"},
+		{1, "rune_diff", "0"},
+		{1, "TotalRuneSwapIn_delta", ""},
+		{1, "tables", ""},
+		{3, "timestamp", "3000"},
+		{3, "rune_diff", "5"},
+		{3, "asset_sql", "8"},
+		{3, "units_diff", "0"},
+		{3, "TotalRuneSwapIn_delta", "20"},
+		{3, "TotalAssetSwapOut_delta", "2"},
+		{3, "TotalRuneStakes_delta", "0"},
+		{3, "tables", "outbound_events swap_events"},
+		{4, "rune_diff", "5"},
+		{4, "TotalRuneSwapIn_delta", ""},
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, test := range tests {
+		record := records[test.row]
+		if len(record) != len(records[0]) {
+			t.Fatalf("row %d has %d columns, want %d", test.row, len(record), len(records[0]))
+		}
+		if got := record[columns[test.column]]; got != test.want {
+			t.Errorf("row %d got %s %q, want %q", test.row, test.column, got, test.want)
+		}
+	}
+
+	status := records[1][columns["status"]]
+	if !strings.Contains(status, "Gas:missing") || strings.Contains(status, "TotalRuneStakes:") {
+		t.Errorf("got status %q, want Gas missing and TotalRuneStakes present", status)
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSink(t, newJSONLSink(file), testResults(t))
+
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var got []resultJSON
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	for dec.More() {
+		var r resultJSON
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal("malformed JSON Lines:", err)
+		}
+		got = append(got, r)
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %d lines, want 4", len(got))
+	}
+
+	tests := []struct {
+		height int64
+		rune   side
+		deltas map[string]int64
+		tables []string
+	}{
+		{1, side{Node: 100, SQL: 100, Block: 100}, nil, nil},
+		{2, side{Node: 100, SQL: 100}, nil, nil},
+		{3, side{Node: 125, SQL: 120, Block: 120, Diff: 5}, map[string]int64{"TotalRuneSwapIn": 20, "TotalAssetSwapOut": 2, "BlockDepth": 120, "BlockAssetDepth": 8}, []string{"outbound_events", "swap_events"}},
+		{4, side{Node: 125, SQL: 120, Diff: 5}, nil, nil},
+	}
+	for i, test := range tests {
+		r := got[i]
+		if r.Pool != testPool || r.Height != test.height {
+			t.Errorf("line %d: got %s on height %d, want %s on height %d", i+1, r.Pool, r.Height, testPool, test.height)
+		}
+		if r.Rune == nil || *r.Rune != test.rune {
+			t.Errorf("line %d: got RUNE side %+v, want %+v", i+1, r.Rune, test.rune)
+		}
+		// only the non-zero deltas are compared
+		deltas := make(map[string]int64)
+		for name, delta := range r.Deltas {
+			if delta != 0 {
+				deltas[name] = delta
+			}
+		}
+		if r.Deltas == nil {
+			deltas = nil
+		}
+		if !reflect.DeepEqual(deltas, test.deltas) {
+			t.Errorf("line %d: got non-zero deltas %v, want %v", i+1, deltas, test.deltas)
+		}
+		if !reflect.DeepEqual(r.Tables, test.tables) {
+			t.Errorf("line %d: got tables %q, want %q", i+1, r.Tables, test.tables)
+		}
+		if r.Status["Gas"] != "missing" {
+			t.Errorf("line %d: got Gas status %q, want missing", i+1, r.Status["Gas"])
+		}
+	}
+}
+
+func TestOpenSinksCheckpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		cp   *checkpoint // nil for none
+		to   int64       // configured to height
+		from int64       // resumes from height; zero for refusal
+	}{
+		{"none", nil, 4, 1},
+		{"same window", &checkpoint{Height: 2, FromHeight: 1, ToHeight: 4, Step: 1}, 4, 3},
+		{"without window", &checkpoint{Height: 2}, 4, 3},
+		{"longer window", &checkpoint{Height: 3, FromHeight: 1, ToHeight: 3, Step: 1}, 4, 4},
+		{"live beyond window", &checkpoint{Height: 6, FromHeight: 1, ToHeight: 4, Step: 1}, 5, 7},
+		{"other from height", &checkpoint{Height: 2, FromHeight: 2, ToHeight: 4, Step: 1}, 4, 0},
+		{"other step", &checkpoint{Height: 3, FromHeight: 1, ToHeight: 4, Step: 2}, 4, 0},
+		{"shorter window", &checkpoint{Height: 4, FromHeight: 1, ToHeight: 4, Step: 1}, 3, 0},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		c := testConfig()
+		c.Reconcile.ToHeight = test.to
+		c.Reconcile.Checkpoint = filepath.Join(dir, "checkpoint")
+		c.Reconcile.Sinks = []SinkConfig{{Type: "csv", Path: filepath.Join(dir, "results.csv")}}
+		if test.cp != nil {
+			if err := test.cp.save(c.Reconcile.Checkpoint); err != nil {
+				t.Fatal("checkpoint save:", err)
+			}
+		}
+
+		s, err := openSinks(c, nil)
+		if test.from == 0 {
+			if err == nil {
+				s.Close()
+				t.Errorf("%s: resumed from height %d", test.name, c.Reconcile.FromHeight)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error: %s", test.name, err)
+			continue
+		}
+		if c.Reconcile.FromHeight != test.from {
+			t.Errorf("%s: got from height %d, want %d", test.name, c.Reconcile.FromHeight, test.from)
+		}
+
+		// checkpoints keep the window of the configuration
+		if err := s.write(test.from, nil); err != nil {
+			t.Errorf("%s: write: %s", test.name, err)
+		}
+		s.Close()
+		cp, err := loadCheckpoint(c.Reconcile.Checkpoint)
+		if err != nil {
+			t.Fatal("checkpoint load:", err)
+		}
+		want := checkpoint{Height: test.from, FromHeight: 1, ToHeight: test.to, Step: 1, Offsets: cp.Offsets}
+		if !reflect.DeepEqual(*cp, want) {
+			t.Errorf("%s: got checkpoint %+v, want %+v", test.name, *cp, want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Store provides the event data. The Postgres implementation runs on the
+// Midgard database, while the in-memory implementation serves tests.
+type Store interface {
+	// Timestamp resolves the block timestamp of height. The return is zero
+	// when height is not in block_log (yet).
+	Timestamp(ctx context.Context, height int64) (int, error)
+
+	// Pools lists every pool with a depth record, together with the block
+	// timestamp of its first appearance.
+	Pools(ctx context.Context) (pools []string, firstSeen []int, err error)
+
+	// DetectRuneAsset returns the asset swapped into pools most, which is RUNE
+	// by design. The return is empty without any swaps.
+	DetectRuneAsset(ctx context.Context) (string, error)
+
+	// Totals reads the value of c per pool on block timestamp ts, as rows
+	// of pool and value. Values may be NULL.
+	Totals(ctx context.Context, c *Component, ts int) (Rows, error)
+
+	// Deltas reads the value of c per pool per block, ordered by block
+	// timestamp, for the blocks after timestamp from up to and including
+	// timestamp to, as rows of pool, block timestamp and value. Values may
+	// be NULL.
+	Deltas(ctx context.Context, c *Component, from, to int) (Rows, error)
+
+	// HeightTotals reads the value of each of components per pool on
+	// height in one round trip, for all pools when pool is empty. Rows
+	// have the index in components, the pool and the value, which may be
+	// NULL. The block timestamp comes as the value of a row with index
+	// -1, when height is in block_log.
+	HeightTotals(ctx context.Context, components []*Component, height int64, pool string) (Rows, error)
+
+	// LastBlock reads the most recent block_log entry. The height is zero
+	// when block_log is empty.
+	LastBlock(ctx context.Context) (height int64, timestamp time.Time, hash, aggState []byte, err error)
+
+	// CommitBlock inserts a block_log entry. The return is false when
+	// height was present already.
+	CommitBlock(ctx context.Context, height int64, timestamp time.Time, hash, aggState []byte) (inserted bool, err error)
+}
+
+// Rows is a query result, as in *sql.Rows.
+type Rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// PostgresStore is a Store on the Midgard database.
+type PostgresStore struct {
+	DB *sql.DB
+
+	// RuneAsset is the RUNE identifier of the network, e.g.,
+	// "BNB.RUNE-B1A" on mainnet or "THOR.RUNE" when native.
+	RuneAsset string
+}
+
+// Timestamp implements the Store interface.
+func (s *PostgresStore) Timestamp(ctx context.Context, height int64) (int, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT timestamp FROM block_log where height = $1", height)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var blockTimestamp int
+	if rows.Next() {
+		if err := rows.Scan(&blockTimestamp); err != nil {
+			return 0, fmt.Errorf("timestamp of height %d: %w", height, err)
+		}
+	}
+	return blockTimestamp, rows.Err()
+}
+
+// Pools implements the Store interface.
+func (s *PostgresStore) Pools(ctx context.Context) (pools []string, firstSeen []int, err error) {
+	rows, err := s.DB.QueryContext(ctx, "select pool, min(block_timestamp) from block_pool_depths group by pool order by pool")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pool string
+		var since int
+		if err := rows.Scan(&pool, &since); err != nil {
+			return nil, nil, err
+		}
+		pools = append(pools, pool)
+		firstSeen = append(firstSeen, since)
+	}
+	return pools, firstSeen, rows.Err()
+}
+
+// DetectRuneAsset implements the Store interface.
+func (s *PostgresStore) DetectRuneAsset(ctx context.Context) (string, error) {
+	rows, err := s.DB.QueryContext(ctx, "select from_asset from swap_events where from_asset != pool group by from_asset order by count(*) desc limit 1")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var asset string
+	if rows.Next() {
+		if err := rows.Scan(&asset); err != nil {
+			return "", err
+		}
+	}
+	return asset, rows.Err()
+}
+
+// Totals implements the Store interface.
+func (s *PostgresStore) Totals(ctx context.Context, c *Component, ts int) (Rows, error) {
+	cond := c.Timestamp + " <= $1"
+	if c.Point {
+		cond = c.Timestamp + " = $1"
+	}
+	q := "select " + c.Pool + ", " + c.Value + " from " + c.From + s.condition(c, cond, 1) +
+		" group by " + c.Pool
+	return s.DB.QueryContext(ctx, q, s.args(c, ts)...)
+}
+
+// Deltas implements the Store interface.
+func (s *PostgresStore) Deltas(ctx context.Context, c *Component, from, to int) (Rows, error) {
+	q := "select " + c.Pool + ", " + c.Timestamp + ", " + c.Value + " from " + c.From +
+		s.condition(c, c.Timestamp+" > $1 and "+c.Timestamp+" <= $2", 2) +
+		" group by " + c.Pool + ", " + c.Timestamp + " order by " + c.Timestamp
+	return s.DB.QueryContext(ctx, q, s.args(c, from, to)...)
+}
+
+// HeightTotals implements the Store interface. The components are combined
+// with UNION ALL, labelled by their index.
+func (s *PostgresStore) HeightTotals(ctx context.Context, components []*Component, height int64, pool string) (Rows, error) {
+	var q strings.Builder
+	q.WriteString("with b as (select timestamp as ts from block_log where height = $1) select -1, '', ts from b")
+	withRune := false
+	for i, c := range components {
+		cond := c.Timestamp + " <= (select ts from b)"
+		if c.Point {
+			cond = c.Timestamp + " = (select ts from b)"
+		}
+		cond += " and ($2 = '' or " + c.Pool + " = $2)"
+		fmt.Fprintf(&q, " union all select %d, %s, %s from %s%s group by %s",
+			i, c.Pool, c.Value, c.From, s.condition(c, cond, 2), c.Pool)
+		withRune = withRune || strings.Contains(c.Where, runeParam)
+	}
+
+	args := []interface{}{height, pool}
+	if withRune {
+		args = append(args, s.RuneAsset)
+	}
+	return s.DB.QueryContext(ctx, q.String(), args...)
+}
+
+// Condition combines the where clause of c with cond. The RUNE asset goes
+// in as the parameter following the argCount parameters of cond.
+func (s *PostgresStore) condition(c *Component, cond string, argCount int) string {
+	if c.Where == "" {
+		return " where " + cond
+	}
+	where := strings.ReplaceAll(c.Where, runeParam, fmt.Sprintf("$%d", argCount+1))
+	return " where " + where + " and " + cond
+}
+
+// Args returns the query arguments for the condition parameters.
+func (s *PostgresStore) args(c *Component, condArgs ...interface{}) []interface{} {
+	if strings.Contains(c.Where, runeParam) {
+		return append(condArgs, s.RuneAsset)
+	}
+	return condArgs
+}
+
+// LastBlock implements the Store interface.
+func (s *PostgresStore) LastBlock(ctx context.Context) (height int64, timestamp time.Time, hash, aggState []byte, err error) {
+	const q = "SELECT height, timestamp, hash, agg_state FROM block_log ORDER BY height DESC LIMIT 1"
+	rows, err := s.DB.QueryContext(ctx, q)
+	if err != nil {
+		return 0, time.Time{}, nil, nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var ns int64
+		if err := rows.Scan(&height, &ns, &hash, &aggState); err != nil {
+			return 0, time.Time{}, nil, nil, err
+		}
+		timestamp = time.Unix(0, ns)
+	}
+	return height, timestamp, hash, aggState, rows.Err()
+}
+
+// CommitBlock implements the Store interface.
+func (s *PostgresStore) CommitBlock(ctx context.Context, height int64, timestamp time.Time, hash, aggState []byte) (inserted bool, err error) {
+	const q = "INSERT INTO block_log (height, timestamp, hash, agg_state) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+	result, err := s.DB.ExecContext(ctx, q, height, timestamp.UnixNano(), hash, aggState)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
@@ -5,18 +5,15 @@ import (
 	"context"
 	"database/sql"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
-// DBQuery is the SQL client.
-var DBQuery func(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
-
-// DBExec is the SQL client.
-var DBExec func(query string, args ...interface{}) (sql.Result, error)
-
 // OutboundTimeout is an upperboundary for the amount of time for a followup on outbound events.
 const OutboundTimeout = time.Hour
 
@@ -33,388 +30,665 @@ type blockTrack struct {
 }
 
 
-type midgard struct {
-	TotalRuneStakes int64
-	TotalRunUnstakes int64
-	TotalRuneSwapIn int64
-	TotalRuneSwapOut int64
-	Fees int64
-	PoolDeductRefunds int64
-	RuneFeesSwaps int64
-	PoolDeductSwaps int64
-	RuneFeeUnstakes int64
-	PoolDeductUnstakes int64
-	Adds int64
-	Rewards int64
-	Errata int64
-	Gas int64
-	BlockDepth int64
-}
-
-// AggTrack has a snapshot of runningTotals.
-type aggTrack struct {
-	AssetE8DepthPerPool map[string]int64
-	RuneE8DepthPerPool  map[string]int64
-}
-
-func FetchHeights()([]int64, error) {
-	const q = "SELECT height, timestamp, hash, " +
-		"agg_state FROM block_log ORDER BY height asc"
-
-	rows, err := DBQuery(context.Background(), q)
-	if err != nil {
-		return nil, err
+// Midgard has the depth & units components of a pool, in E8 unless
+// otherwise specified.
+type Midgard struct {
+	// Components has the values in the order of the formula.
+	Components []int64
 
-	}
-	defer rows.Close()
+	BlockDepth      int64 // RUNE according to block_pool_depths
+	BlockAssetDepth int64 // asset according to block_pool_depths
 
-	var track blockTrack
+	// Status has the state of each value, in the order of ComponentNames.
+	Status []Status
+}
 
-	var offsets []int64
+// Status is the state of a component value.
+type Status byte
 
+const (
+	Missing Status = iota // no rows, or NULL values only
+	Present               // rows with a non-zero total
+	Zero                  // rows with a zero total
+	Failed                // query error; the value is not reliable
+)
 
-	for rows.Next() {
-		var ns int64
-		var aggSerial []byte
-		rows.Scan(&track.Height, &ns, &track.Hash, &aggSerial)
-		track.Timestamp = time.Unix(0, ns)
-		if err := gob.NewDecoder(bytes.NewReader(aggSerial)).Decode(&track.aggTrack);
-			err != nil {
-			return nil, err
-		}
-		offsets =  append(offsets, track.Height)
+// String returns the CSV & JSON representation.
+func (s Status) String() string {
+	switch s {
+	case Missing:
+		return "missing"
+	case Present:
+		return "ok"
+	case Zero:
+		return "zero"
+	case Failed:
+		return "failed"
+	}
+	return fmt.Sprintf("status %d", byte(s))
+}
 
+// newMidgard returns the state of a pool without any rows.
+func newMidgard() *Midgard {
+	return &Midgard{
+		Components: make([]int64, len(formula)),
+		Status:     make([]Status, len(components)),
 	}
-
-	return offsets, rows.Err()
-
 }
 
-func GetBlockDepth(pool string, blockTimeStamp  int)(BlockDepth int64, err error){
-	rows, err := DBQuery(context.Background(), "select rune_e8 from block_pool_depths where pool = $1 and block_timestamp = $2",pool, blockTimeStamp)
-	if err != nil {
-		return 0000, err
-	}
-	defer rows.Close()
+// AggTrack has a snapshot of runningTotals.
+type aggTrack struct {
+	AssetE8DepthPerPool map[string]int64
+	RuneE8DepthPerPool  map[string]int64
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.BlockDepth)
-	}
+// Component is an aggregate of one event type, per pool and per block.
+type Component struct {
+	Name string `json:"name"`
+	// Side is either "rune", "asset" or "units".
+	Side string `json:"side"`
+	// Sign is either "+" or "-" for the contribution to the depth of
+	// the side, or "none" for components which are tracked only.
+	Sign string `json:"sign"`
+
+	Value     string `json:"value"`     // SQL aggregate
+	From      string `json:"from"`      // SQL tables
+	Where     string `json:"where"`     // optional SQL condition, with runeParam for the RUNE asset
+	Pool      string `json:"pool"`      // SQL pool column
+	Timestamp string `json:"timestamp"` // SQL block timestamp column
+
+	// Point components are the state at a block, as opposed to a sum
+	// over all blocks up to and including the block.
+	Point bool `json:"point"`
+}
 
-	log.Print("BlockDepth ", mg.BlockDepth)
+// Formula defines the depth of each side as the sum of its components.
+type Formula []Component
+
+// RuneParam is the placeholder for the RUNE asset in component conditions.
+const runeParam = "$rune"
+
+// DefaultFormula is the depth & units decomposition as implemented by
+// THORNode. Fees on the RUNE side are tracked only.
+var DefaultFormula = Formula{
+	{Name: "TotalRuneStakes", Side: "rune", Sign: "+",
+		Value: "sum(rune_e8)", From: "stake_events", Pool: "pool", Timestamp: "block_timestamp"},
+	{Name: "TotalRunUnstakes", Side: "rune", Sign: "-",
+		Value: "sum(oe.asset_e8)", From: "outbound_events oe join unstake_events ue on (ue.tx = oe.in_tx)",
+		Where: "oe.asset = $rune", Pool: "ue.pool", Timestamp: "oe.block_timestamp"},
+	{Name: "TotalRuneSwapIn", Side: "rune", Sign: "+",
+		Value: "sum(from_e8)", From: "swap_events",
+		Where: "from_asset = $rune", Pool: "pool", Timestamp: "block_timestamp"},
+	{Name: "TotalRuneSwapOut", Side: "rune", Sign: "-",
+		Value: "sum(oe.asset_e8)", From: "outbound_events oe join swap_events se on (se.tx = oe.in_tx)",
+		Where: "oe.asset = $rune and se.from_asset != $rune", Pool: "se.pool", Timestamp: "se.block_timestamp"},
+	{Name: "Fees", Side: "rune", Sign: "none",
+		Value: "sum(fe.asset_e8)", From: "fee_events fe join swap_events se on (se.tx = fe.tx)",
+		Where: "fe.asset = $rune", Pool: "se.pool", Timestamp: "se.block_timestamp"},
+	{Name: "PoolDeductRefunds", Side: "rune", Sign: "-",
+		Value: "sum(fe.pool_deduct)", From: "fee_events fe join refund_events re on (re.tx = fe.tx)",
+		Where: "fe.asset != $rune", Pool: "re.asset", Timestamp: "re.block_timestamp"},
+	{Name: "RuneFeesSwaps", Side: "rune", Sign: "-",
+		Value: "sum(fe.asset_e8)", From: "fee_events fe join swap_events se on (se.tx = fe.tx)",
+		Where: "fe.asset = $rune", Pool: "se.pool", Timestamp: "se.block_timestamp"},
+	{Name: "PoolDeductSwaps", Side: "rune", Sign: "-",
+		Value: "sum(fe.pool_deduct)", From: "fee_events fe join swap_events se on (se.tx = fe.tx)",
+		Where: "fe.asset != $rune", Pool: "se.pool", Timestamp: "se.block_timestamp"},
+	{Name: "RuneFeeUnstakes", Side: "rune", Sign: "-",
+		Value: "sum(fe.asset_e8)", From: "fee_events fe join unstake_events ue on (ue.tx = fe.tx)",
+		Where: "fe.asset = $rune", Pool: "ue.pool", Timestamp: "fe.block_timestamp"},
+	{Name: "PoolDeductUnstakes", Side: "rune", Sign: "-",
+		Value: "sum(fe.pool_deduct)", From: "fee_events fe join unstake_events ue on (ue.tx = fe.tx)",
+		Where: "fe.asset != $rune", Pool: "ue.pool", Timestamp: "fe.block_timestamp"},
+	{Name: "Adds", Side: "rune", Sign: "+",
+		Value: "sum(rune_e8)", From: "add_events", Pool: "pool", Timestamp: "block_timestamp"},
+	{Name: "Rewards", Side: "rune", Sign: "+",
+		Value: "sum(rune_e8)", From: "rewards_event_entries", Pool: "pool", Timestamp: "block_timestamp"},
+	{Name: "Errata", Side: "rune", Sign: "+",
+		Value: "sum(rune_e8)", From: "errata_events", Pool: "asset", Timestamp: "block_timestamp"},
+	{Name: "Gas", Side: "rune", Sign: "+",
+		Value: "sum(rune_e8)", From: "gas_events", Pool: "asset", Timestamp: "block_timestamp"},
+
+	{Name: "TotalAssetStakes", Side: "asset", Sign: "+",
+		Value: "sum(asset_e8)", From: "stake_events", Pool: "pool", Timestamp: "block_timestamp"},
+	{Name: "TotalAssetUnstakes", Side: "asset", Sign: "-",
+		Value: "sum(oe.asset_e8)", From: "outbound_events oe join unstake_events ue on (ue.tx = oe.in_tx)",
+		Where: "oe.asset = ue.pool", Pool: "ue.pool", Timestamp: "oe.block_timestamp"},
+	{Name: "TotalAssetSwapIn", Side: "asset", Sign: "+",
+		Value: "sum(from_e8)", From: "swap_events",
+		Where: "from_asset = pool", Pool: "pool", Timestamp: "block_timestamp"},
+	{Name: "TotalAssetSwapOut", Side: "asset", Sign: "-",
+		Value: "sum(oe.asset_e8)", From: "outbound_events oe join swap_events se on (se.tx = oe.in_tx)",
+		Where: "oe.asset = se.pool and se.from_asset = $rune", Pool: "se.pool", Timestamp: "se.block_timestamp"},
+	{Name: "AssetPoolDeductRefunds", Side: "asset", Sign: "-",
+		Value: "sum(fe.pool_deduct)", From: "fee_events fe join refund_events re on (re.tx = fe.tx)",
+		Where: "fe.asset = $rune", Pool: "re.asset", Timestamp: "re.block_timestamp"},
+	{Name: "AssetFeesSwaps", Side: "asset", Sign: "-",
+		Value: "sum(fe.asset_e8)", From: "fee_events fe join swap_events se on (se.tx = fe.tx)",
+		Where: "fe.asset = se.pool", Pool: "se.pool", Timestamp: "se.block_timestamp"},
+	{Name: "AssetPoolDeductSwaps", Side: "asset", Sign: "-",
+		Value: "sum(fe.pool_deduct)", From: "fee_events fe join swap_events se on (se.tx = fe.tx)",
+		Where: "fe.asset = $rune", Pool: "se.pool", Timestamp: "se.block_timestamp"},
+	{Name: "AssetFeeUnstakes", Side: "asset", Sign: "-",
+		Value: "sum(fe.asset_e8)", From: "fee_events fe join unstake_events ue on (ue.tx = fe.tx)",
+		Where: "fe.asset = ue.pool", Pool: "ue.pool", Timestamp: "fe.block_timestamp"},
+	{Name: "AssetPoolDeductUnstakes", Side: "asset", Sign: "-",
+		Value: "sum(fe.pool_deduct)", From: "fee_events fe join unstake_events ue on (ue.tx = fe.tx)",
+		Where: "fe.asset = $rune", Pool: "ue.pool", Timestamp: "fe.block_timestamp"},
+	{Name: "AssetAdds", Side: "asset", Sign: "+",
+		Value: "sum(asset_e8)", From: "add_events", Pool: "pool", Timestamp: "block_timestamp"},
+	{Name: "AssetErrata", Side: "asset", Sign: "+",
+		Value: "sum(asset_e8)", From: "errata_events", Pool: "asset", Timestamp: "block_timestamp"},
+	{Name: "AssetGas", Side: "asset", Sign: "-",
+		Value: "sum(asset_e8)", From: "gas_events", Pool: "asset", Timestamp: "block_timestamp"},
+
+	{Name: "TotalStakeUnits", Side: "units", Sign: "+",
+		Value: "sum(stake_units)", From: "stake_events", Pool: "pool", Timestamp: "block_timestamp"},
+	{Name: "TotalUnstakeUnits", Side: "units", Sign: "-",
+		Value: "sum(stake_units)", From: "unstake_events", Pool: "pool", Timestamp: "block_timestamp"},
+}
 
-	return mg.BlockDepth, nil
+// BlockComponents are the depths according to block_pool_depths, which
+// are the reference rather than part of the formula.
+var blockComponents = []*component{
+	{Component{Name: "BlockDepth", Side: "rune", Sign: "none",
+		Value: "sum(rune_e8)", From: "block_pool_depths", Pool: "pool", Timestamp: "block_timestamp", Point: true},
+		func(m *Midgard) *int64 { return &m.BlockDepth }, 0},
+	{Component{Name: "BlockAssetDepth", Side: "asset", Sign: "none",
+		Value: "sum(asset_e8)", From: "block_pool_depths", Pool: "pool", Timestamp: "block_timestamp", Point: true},
+		func(m *Midgard) *int64 { return &m.BlockAssetDepth }, 0},
+}
 
+// Component is a Component with its Midgard field.
+type component struct {
+	Component
+	field func(*Midgard) *int64
 
+	index int // position in components
+}
 
+// Formula in use, with the block components appended.
+var (
+	formula    Formula
+	components []*component
+)
 
+func init() {
+	if err := SetFormula(DefaultFormula); err != nil {
+		panic(err)
+	}
 }
 
-func FetchTimestamp(height string)(blockTimestamp int, error error){
-	rows, err := DBQuery(context.Background(), "SELECT timestamp FROM block_log where height = $1", height)
-	if err != nil {
-		return 0000, err
+// SetFormula replaces the formula in use. The component order defines the
+// order of Midgard.Components and of ComponentNames.
+func SetFormula(f Formula) error {
+	names := make(map[string]bool)
+	for _, c := range blockComponents {
+		names[c.Name] = true
+	}
+	for _, c := range f {
+		switch {
+		case c.Name == "":
+			return errors.New("formula component without name")
+		case names[c.Name]:
+			return fmt.Errorf("formula component %q: duplicate name", c.Name)
+		case c.Side != "rune" && c.Side != "asset" && c.Side != "units":
+			return fmt.Errorf("formula component %q: unknown side %q", c.Name, c.Side)
+		case c.Sign != "+" && c.Sign != "-" && c.Sign != "none":
+			return fmt.Errorf("formula component %q: sign %q is not one of \"+\", \"-\" or \"none\"", c.Name, c.Sign)
+		case c.Value == "" || c.From == "" || c.Pool == "" || c.Timestamp == "":
+			return fmt.Errorf("formula component %q: value, from, pool and timestamp are required", c.Name)
+		}
+		names[c.Name] = true
 	}
-	defer rows.Close()
 
-	var track blockTrack
-	if rows.Next() {
-		rows.Scan(&track.BlockTimestamp)
+	formula = append(Formula(nil), f...)
+	components = make([]*component, 0, len(f)+len(blockComponents))
+	for i := range formula {
+		i := i
+		components = append(components, &component{formula[i], func(m *Midgard) *int64 { return &m.Components[i] }, i})
 	}
-
-	log.Print("timestamp ", track.BlockTimestamp)
-
-	return track.BlockTimestamp, nil
-
+	for _, c := range blockComponents {
+		c.index = len(components)
+		components = append(components, c)
+	}
+	return nil
 }
 
-
-func GetTotalRuneStakes(pool string, blockTimeStamp  int)(
-	TotalRuneStakes int64, err error){
-	rows, err := DBQuery(context.Background(), "select sum(rune_e8) from stake_events where pool = $1 and" +
-		" block_timestamp <= $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+// ComponentNames lists the Midgard fields in the order of Values.
+func ComponentNames() []string {
+	names := make([]string, len(components))
+	for i, c := range components {
+		names[i] = c.Name
 	}
-	defer rows.Close()
+	return names
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.TotalRuneStakes)
+// Values lists the Midgard fields in the order of ComponentNames.
+func (m *Midgard) Values() []int64 {
+	values := make([]int64, len(components))
+	copy(values, m.Components)
+	for i, c := range blockComponents {
+		values[len(formula)+i] = *c.field(m)
 	}
-	log.Print("TotalRuneStakes ", mg.TotalRuneStakes)
-
-	return mg.TotalRuneStakes, nil
+	return values
 }
 
-func GetTotalRunUnstakes(pool string, blockTimeStamp  int)(
-	TotalRunUnstakes int64, err error){
-	rows, err := DBQuery(context.Background(),  "select sum(oe." +
-		"asset_e8) from outbound_events oe join unstake_events ue on (ue." +
-		"tx = oe.in_tx) where oe.asset = 'BNB.RUNE-B1A' and ue." +
-		"pool = $1 and oe.block_timestamp <= $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+// Depth returns the formula outcome for side.
+func (m *Midgard) Depth(side string) int64 {
+	var sum int64
+	for i, v := range m.Components {
+		switch c := &formula[i]; {
+		case c.Side != side:
+			continue
+		case c.Sign == "+":
+			sum += v
+		case c.Sign == "-":
+			sum -= v
+		}
 	}
-	defer rows.Close()
+	return sum
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.TotalRunUnstakes)
+// Failed returns whether any of the components of side is Failed, in
+// which case the Depth of side is unreliable.
+func (m *Midgard) Failed(side string) bool {
+	for i := range formula {
+		if formula[i].Side == side && i < len(m.Status) && m.Status[i] == Failed {
+			return true
+		}
 	}
-	log.Print("TotalRunUnstakes ", mg.TotalRunUnstakes)
-
-	return mg.TotalRunUnstakes, nil
+	return false
 }
 
-func GetTotalRuneSwapIn(pool string, blockTimeStamp  int)(
-	TotalRuneSwapIn int64, err error){
+// Clone returns a deep copy.
+func (m *Midgard) clone() Midgard {
+	c := *m
+	c.Components = append([]int64(nil), m.Components...)
+	c.Status = append([]Status(nil), m.Status...)
+	return c
+}
 
-	rows, err := DBQuery(context.Background(),  "select sum(from_e8) from swap_events where pool = $1 and" +
-		" from_asset = 'BNB.RUNE-B1A' and block_timestamp <= $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+// Tables lists the SQL tables in use.
+func (c *component) tables() []string {
+	var tables []string
+	words := strings.Fields(c.From)
+	for i, w := range words {
+		if i == 0 || words[i-1] == "join" {
+			tables = append(tables, w)
+		}
 	}
-	defer rows.Close()
+	return tables
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.TotalRuneSwapIn)
-	}
+// Stream walks all pools block by block. Each component is read once, with
+// a single ordered query, and the running totals are kept in memory. A full
+// chain pass is thus linear in the number of events.
+type Stream struct {
+	store   Store
+	ctx     context.Context // of the queries
+	ts      int
+	to      int // end of the cursors
+	totals  map[string]*Midgard
+	cursors []*cursor
+	failed  []bool // per component
+
+	// event tables with rows since the previous Advance, per pool
+	tables map[string][]string
+}
 
-	log.Print("TotalRuneSwapIn ", mg.TotalRuneSwapIn)
+// Cursor is the read position of a component in a Stream.
+type cursor struct {
+	*component
+	rows Rows
 
-	return mg.TotalRuneSwapIn, nil
+	// pending row
+	ok   bool
+	pool string
+	ts   int
+	e8   sql.NullInt64
 }
 
-func GetTotalRuneSwapOut(pool string, blockTimeStamp  int)(
-	TotalRuneSwapOut int64, err error){
-
-	rows, err := DBQuery(context.Background(), "select sum(asset_e8) from outbound_events oe join swap_events" +
-		" se on (se.tx = oe.in_tx) where oe.asset = 'BNB.RUNE-B1A' and se." +
-		"pool = $1 and se.from_asset != 'BNB.RUNE-B1A' and se." +
-		"block_timestamp <= $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+func (c *cursor) next() error {
+	c.ok = c.rows.Next()
+	if !c.ok {
+		return c.rows.Err()
 	}
-	defer rows.Close()
+	if err := c.rows.Scan(&c.pool, &c.ts, &c.e8); err != nil {
+		return fmt.Errorf("%s stream: %w", c.Name, err)
+	}
+	return nil
+}
 
-	var mg midgard
+// OpenStream positions on block timestamp from (inclusive), with the option
+// to Advance up to block timestamp to (inclusive). Cancellation of ctx fails
+// any Advance thereafter. Components with a query error are marked as Failed
+// in each of the totals.
+func OpenStream(ctx context.Context, store Store, from, to int) (*Stream, error) {
+	s := newStream(ctx, store, from)
 
-	if rows.Next() {
-		rows.Scan(&mg.TotalRuneSwapOut)
+	for _, c := range components {
+		if err := s.load(c, from); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err := s.openCursor(c, from, to); err != nil {
+			s.Close()
+			return nil, err
+		}
 	}
+	s.to = to
 
-	log.Print("TotalRuneSwapOut ", mg.TotalRuneSwapOut)
-
-	return mg.TotalRuneSwapOut, nil
+	return s, nil
 }
 
-func GetFees(pool string, blockTimeStamp  int)(Fees int64, err error){
-	rows, err := DBQuery(context.Background(), "select sum(asset_e8) from fee_events fe join swap_events se on" +
-		" (se.tx = fe.tx) where fe.asset = 'BNB.RUNE-B1A' and se." +
-		"pool = $1 and se.block_timestamp <= $2", pool, blockTimeStamp)
+// OpenCursor reads component c from block timestamp from (exclusive) up to
+// block timestamp to (inclusive).
+func (s *Stream) openCursor(c *component, from, to int) error {
+	rows, err := s.store.Deltas(s.ctx, &c.Component, from, to)
 	if err != nil {
-		return 0, err
+		return s.fail(c, fmt.Errorf("%s stream: %w", c.Name, err))
 	}
-	defer rows.Close()
+	cur := &cursor{component: c, rows: rows}
+	s.cursors = append(s.cursors, cur)
+	return s.next(cur)
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.Fees)
+// Extend moves the option to Advance up to block timestamp to (inclusive),
+// for streams which follow the chain. Only the rows past the previous end are
+// read. The position must be at the previous end.
+func (s *Stream) Extend(to int) error {
+	if to <= s.to {
+		return nil
+	}
+	if s.ts != s.to {
+		return fmt.Errorf("stream extend to block timestamp %d denied: at %d before end %d", to, s.ts, s.to)
 	}
-	log.Print("Fees ", mg.Fees)
 
-	return mg.Fees, nil
+	cursors := s.cursors
+	s.cursors = nil
+	for _, cur := range cursors {
+		cur.rows.Close()
+	}
+	for _, c := range components {
+		if s.failed[c.index] {
+			continue // totals unknown already
+		}
+		if err := s.openCursor(c, s.to, to); err != nil {
+			return err
+		}
+	}
+	s.to = to
+	return nil
 }
 
-func GetPoolDeductRefunds(pool string, blockTimeStamp  int)(
-	PoolDeductRefunds int64, err error){
-	rows, err := DBQuery(context.Background(), "select sum(pool_deduct) from fee_events fe join refund_events" +
-		" re on (re.tx = fe.tx) where fe.asset != 'BNB.RUNE-B1A' and re." +
-		"asset = $1 and re.block_timestamp <= $2", pool, blockTimeStamp)
+// TotalsAtHeight gets the state on height with a single query, for all pools
+// when pool is empty. The block timestamp is zero when height is not in
+// block_log (yet). When the single query fails, each component is queried
+// on its own instead, with any component in error marked as Failed.
+func TotalsAtHeight(ctx context.Context, store Store, height int64, pool string) (blockTimestamp int, totals map[string]Midgard, err error) {
+	all := make([]*Component, len(components))
+	for i, c := range components {
+		all[i] = &c.Component
+	}
+	s := newStream(ctx, store, 0)
+	rows, err := store.HeightTotals(ctx, all, height, pool)
+	if err == nil {
+		blockTimestamp, err = s.loadHeight(rows)
+		rows.Close()
+	}
 	if err != nil {
-		return 0, err
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, nil, ctxErr
+		}
+		log.Printf("totals on height %d per component on %s", height, err)
+		return totalsPerComponent(ctx, store, height, pool)
 	}
-	defer rows.Close()
+	return blockTimestamp, s.poolTotals(pool), nil
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.PoolDeductRefunds)
+// LoadHeight sets the totals from the rows of Store.HeightTotals. The return
+// is the block timestamp.
+func (s *Stream) loadHeight(rows Rows) (blockTimestamp int, err error) {
+	for rows.Next() {
+		var index int
+		var pool string
+		var e8 sql.NullInt64
+		if err := rows.Scan(&index, &pool, &e8); err != nil {
+			return 0, err
+		}
+		switch {
+		case index < 0:
+			blockTimestamp = int(e8.Int64)
+		case index >= len(components):
+			return 0, fmt.Errorf("component index %d out of range", index)
+		case e8.Valid:
+			m := s.pool(pool)
+			*components[index].field(m) = e8.Int64
+			m.Status[index] = Present
+		}
 	}
-	log.Print("PoolDeductRefunds ", mg.PoolDeductRefunds)
-
-	return mg.PoolDeductRefunds, nil
+	return blockTimestamp, rows.Err()
 }
 
-func GetRuneFeesSwaps(pool string, blockTimeStamp  int)(
-	RuneFeesSwaps int64, err error){
-
-	rows, err := DBQuery(context.Background(), "select sum(asset_e8) from fee_events fe join swap_events se on" +
-		" (se.tx = fe.tx) where fe.asset = 'BNB.RUNE-B1A' and se." +
-		"pool = $1 and se.block_timestamp <= $2", pool, blockTimeStamp)
+// TotalsPerComponent is TotalsAtHeight with a query per component.
+func totalsPerComponent(ctx context.Context, store Store, height int64, pool string) (blockTimestamp int, totals map[string]Midgard, err error) {
+	blockTimestamp, err = store.Timestamp(ctx, height)
 	if err != nil {
-		return 0, err
+		return 0, nil, fmt.Errorf("totals on height %d: %w", height, err)
 	}
-	defer rows.Close()
-
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.RuneFeesSwaps)
+	if blockTimestamp == 0 {
+		return 0, nil, nil
 	}
 
-	log.Print("RuneFeesSwaps ", mg.RuneFeesSwaps)
-
-	return mg.RuneFeesSwaps, nil
+	s := newStream(ctx, store, blockTimestamp)
+	for _, c := range components {
+		if err := s.load(c, blockTimestamp); err != nil {
+			return 0, nil, err
+		}
+	}
+	if pool != "" {
+		s.pool(pool) // reports the failures, even without rows
+	}
+	return blockTimestamp, s.poolTotals(pool), nil
 }
 
-func GetPoolDeductSwaps(pool string, blockTimeStamp  int)(
-	PoolDeductSwaps int64, err error){
-	rows, err := DBQuery(context.Background(), "select sum(pool_deduct) from fee_events fe join swap_events se" +
-		" on (se.tx = fe.tx) where fe.asset != 'BNB.RUNE-B1A' and se." +
-		"pool = $1 and se.block_timestamp <= $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+// PoolTotals returns the totals at the current position, for all pools
+// when pool is empty.
+func (s *Stream) poolTotals(pool string) map[string]Midgard {
+	totals := make(map[string]Midgard, len(s.totals))
+	for name := range s.totals {
+		if pool == "" || name == pool {
+			totals[name] = s.Totals(name)
+		}
 	}
-	defer rows.Close()
+	return totals
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.PoolDeductSwaps)
+func newStream(ctx context.Context, store Store, ts int) *Stream {
+	return &Stream{
+		store:  store,
+		ctx:    ctx,
+		ts:     ts,
+		totals: make(map[string]*Midgard),
+		failed: make([]bool, len(components)),
 	}
-
-	log.Print("PoolDeductSwaps ", mg.PoolDeductSwaps)
-
-	return mg.PoolDeductSwaps, nil
 }
 
-func GetRuneFeeUnstakes(pool string, blockTimeStamp  int)(
-	RuneFeeUnstakes int64, err error){
-	rows, err := DBQuery(context.Background(), "select sum(fe.asset_e8) from fee_events fe join unstake_events" +
-		" ue on (ue.tx = fe.tx) where fe.asset = 'BNB.RUNE-B1A' and ue." +
-		"pool = $1 and fe.block_timestamp <= $2", pool, blockTimeStamp)
+// Load sets the totals of component c on block timestamp ts.
+func (s *Stream) load(c *component, ts int) error {
+	rows, err := s.store.Totals(s.ctx, &c.Component, ts)
 	if err != nil {
-		return 0, err
+		return s.fail(c, fmt.Errorf("%s totals: %w", c.Name, err))
 	}
 	defer rows.Close()
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.RuneFeeUnstakes)
+	for rows.Next() {
+		var pool string
+		var e8 sql.NullInt64
+		if err := rows.Scan(&pool, &e8); err != nil {
+			return s.fail(c, fmt.Errorf("%s totals: %w", c.Name, err))
+		}
+		if e8.Valid {
+			m := s.pool(pool)
+			*c.field(m) = e8.Int64
+			m.Status[c.index] = Present
+		}
 	}
-	log.Print("RuneFeeUnstakes ", mg.RuneFeeUnstakes)
-
-	return mg.RuneFeeUnstakes, nil
+	if err := rows.Err(); err != nil {
+		return s.fail(c, fmt.Errorf("%s totals: %w", c.Name, err))
+	}
+	return nil
 }
 
-func GetPoolDeductUnstakes(pool string, blockTimeStamp  int)(
-	PoolDeductUnstakes int64, err error){
-	rows, err := DBQuery(context.Background(),  "select sum(pool_deduct) from fee_events fe join unstake_events" +
-		" ue on (ue.tx = fe.tx) where fe.asset != 'BNB.RUNE-B1A' and ue." +
-		"pool = 'BNB.BNB' and fe.block_timestamp <= $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+// Fail marks component c as Failed on err, such that the other components
+// continue. The return is an error only on cancellation, which is no
+// component failure.
+func (s *Stream) fail(c *component, err error) error {
+	if ctxErr := s.ctx.Err(); ctxErr != nil {
+		return ctxErr
 	}
-	defer rows.Close()
-
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.PoolDeductUnstakes)
+	if !s.failed[c.index] {
+		log.Print("component marked as failed on ", err)
+		s.failed[c.index] = true
 	}
-
-	log.Print("PoolDeductUnstakes ", mg.PoolDeductUnstakes)
-
-	return mg.PoolDeductRefunds, nil
+	return nil
 }
 
-func GetAdds(pool string, blockTimeStamp  int) (Add int64, err error) {
-	rows, err := DBQuery(context.Background(), "select sum(rune_e8) from add_events where pool = $1 and" +
-		" block_timestamp <=  $2", pool, blockTimeStamp)
+// Next reads the pending row of cur. Read errors end the cursor.
+func (s *Stream) next(cur *cursor) error {
+	err := cur.next()
 	if err != nil {
-		return 0, err
+		cur.ok = false
+		return s.fail(cur.component, err)
 	}
-	defer rows.Close()
+	return nil
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.Adds)
+func (s *Stream) pool(pool string) *Midgard {
+	m, ok := s.totals[pool]
+	if !ok {
+		m = newMidgard()
+		s.totals[pool] = m
 	}
-	log.Print("Adds ", mg.Adds)
-
-	return mg.Rewards, nil
+	return m
 }
 
-func GetRewards(pool string, blockTimeStamp  int)(Rewards int64, err error)  {
-	rows, err := DBQuery(context.Background(), "select sum(rune_e8) from rewards_event_entries where pool" +
-		" = $1 and block_timestamp <=  $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+// Advance moves the position to block timestamp ts. Streams go forward only,
+// up to their end.
+func (s *Stream) Advance(ts int) error {
+	if ts < s.ts {
+		return fmt.Errorf("stream advance to block timestamp %d denied: already at %d", ts, s.ts)
 	}
-	defer rows.Close()
-
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.Rewards)
+	if ts > s.to {
+		return fmt.Errorf("stream advance to block timestamp %d denied: beyond end %d", ts, s.to)
 	}
+	if ts == s.ts {
+		return nil
+	}
+	s.ts = ts
+	s.tables = make(map[string][]string)
 
-	log.Print("Rewards ", mg.Rewards)
-
-	return mg.Rewards, nil
-}
+	for _, cur := range s.cursors {
+		if cur.Point {
+			for _, m := range s.totals {
+				*cur.field(m) = 0
+				m.Status[cur.index] = Missing
+			}
+		}
 
-func GetErrata(pool string, blockTimeStamp  int)(Errata int64, err error){
-	rows, err := DBQuery(context.Background(), "select sum(rune_e8) from errata_events where asset = $1 and" +
-		" block_timestamp <=  $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+		for cur.ok && cur.ts <= ts {
+			if cur.e8.Valid && (!cur.Point || cur.ts == ts) {
+				m := s.pool(cur.pool)
+				*cur.field(m) += cur.e8.Int64
+				m.Status[cur.index] = Present
+				if !cur.Point {
+					s.markTables(cur.pool, cur.component)
+				}
+			}
+			if err := s.next(cur); err != nil {
+				return err
+			}
+		}
 	}
-	defer rows.Close()
+	return nil
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.Errata)
+func (s *Stream) markTables(pool string, c *component) {
+	for _, table := range c.tables() {
+		if !containsString(s.tables[pool], table) {
+			s.tables[pool] = append(s.tables[pool], table)
+		}
 	}
+}
 
-	log.Print("Errata ", mg.Errata)
-
-	return mg.Errata, nil
+// Tables gets the event tables with rows for pool since the previous Advance,
+// in alphabetical order.
+func (s *Stream) Tables(pool string) []string {
+	tables := append([]string(nil), s.tables[pool]...)
+	sort.Strings(tables)
+	return tables
 }
 
-func GetGas(pool string, blockTimeStamp  int) (Gas int64, err error) {
-	rows, err := DBQuery(context.Background(), "select sum(rune_e8) from gas_events where asset = $1 and" +
-		" block_timestamp <= $2", pool, blockTimeStamp)
-	if err != nil {
-		return 0, err
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
 	}
-	defer rows.Close()
+	return false
+}
 
-	var mg midgard
-	if rows.Next() {
-		rows.Scan(&mg.Gas)
+// Pools lists each pool with totals at the current position, in alphabetical
+// order.
+func (s *Stream) Pools() []string {
+	pools := make([]string, 0, len(s.totals))
+	for pool := range s.totals {
+		pools = append(pools, pool)
 	}
+	sort.Strings(pools)
+	return pools
+}
 
-	log.Print("Gas ", mg.Gas)
-
-	return mg.Gas, nil
+// Totals gets the state of pool at the current position.
+func (s *Stream) Totals(pool string) Midgard {
+	m, ok := s.totals[pool]
+	if !ok {
+		m = newMidgard()
+	}
+	totals := m.clone()
+	values := totals.Values()
+	for i := range totals.Status {
+		switch {
+		case s.failed[i]:
+			totals.Status[i] = Failed
+		case totals.Status[i] == Present && values[i] == 0:
+			totals.Status[i] = Zero
+		}
+	}
+	return totals
 }
 
+// Close releases all resources.
+func (s *Stream) Close() error {
+	var err error
+	for _, cur := range s.cursors {
+		if closeErr := cur.rows.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
 
 // Setup initializes the package. The previous state is restored (if there was any).
-func Setup() (lastBlockHeight int64, lastBlockTimestamp time.Time, lastBlockHash []byte, err error) {
-	const q = "SELECT height, timestamp, hash, agg_state FROM block_log ORDER BY height DESC LIMIT 1"
-	rows, err := DBQuery(context.Background(), q)
+func Setup(store Store) (lastBlockHeight int64, lastBlockTimestamp time.Time, lastBlockHash []byte, err error) {
+	var track blockTrack
+	var aggSerial []byte
+	track.Height, track.Timestamp, track.Hash, aggSerial, err = store.LastBlock(context.Background())
 	if err != nil {
 		return 0, time.Time{}, nil, fmt.Errorf("last block lookup: %w", err)
 	}
-	defer rows.Close()
-
-	var track blockTrack
-	if rows.Next() {
-		var ns int64
-		var aggSerial []byte
-		rows.Scan(&track.Height, &ns, &track.Hash, &aggSerial)
-		track.Timestamp = time.Unix(0, ns)
+	if track.Height != 0 {
 		if err := gob.NewDecoder(bytes.NewReader(aggSerial)).Decode(&track.aggTrack);
 		err != nil {
 			return 0, time.Time{}, nil, fmt.Errorf("restore with malformed aggregation state denied on %w", err)
@@ -434,12 +708,12 @@ func Setup() (lastBlockHeight int64, lastBlockTimestamp time.Time, lastBlockHash
 		recorder.runeE8DepthPerPool[pool] = &v
 	}
 
-	return track.Height, track.Timestamp, track.Hash, rows.Err()
+	return track.Height, track.Timestamp, track.Hash, nil
 }
 
 // CommitBlock marks the given height as done.
 // Invokation of EventListener during CommitBlock causes race conditions!
-func CommitBlock(height int64, timestamp time.Time, hash []byte) error {
+func CommitBlock(store Store, height int64, timestamp time.Time, hash []byte) error {
 	// in-memory snapshot
 	track := blockTrack{
 		Height:    height,
@@ -458,16 +732,11 @@ func CommitBlock(height int64, timestamp time.Time, hash []byte) error {
 		// won't bing the service down, but prevents state recovery
 		log.Print("aggregation state ommited from persistence:", err)
 	}
-	const q = "INSERT INTO block_log (height, timestamp, hash, agg_state) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
-	result, err := DBExec(q, height, timestamp.UnixNano(), hash, aggSerial.Bytes())
+	inserted, err := store.CommitBlock(context.Background(), height, timestamp, hash, aggSerial.Bytes())
 	if err != nil {
 		return fmt.Errorf("persist block height %d: %w", height, err)
 	}
-	n, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("persist block height %d result: %w", height, err)
-	}
-	if n == 0 {
+	if !inserted {
 		log.Printf("block height %d already committed", height)
 	}
 
@@ -0,0 +1,332 @@
+package timeseries_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"gitlab.com/thorchain/midgard/internal/timeseries"
+	"gitlab.com/thorchain/midgard/internal/timeseries/timeseriestest"
+)
+
+const testPool = "BNB.BNB"
+
+// ComponentIndex returns the position of name in the Status of a Midgard.
+func componentIndex(t *testing.T, name string) int {
+	t.Helper()
+	for i, n := range timeseries.ComponentNames() {
+		if n == name {
+			return i
+		}
+	}
+	t.Fatalf("no component %q", name)
+	return -1
+}
+
+// TestStore has blocks on height 1 and 2, with the pool present from the
+// first one.
+func testStore() *timeseriestest.Store {
+	var s timeseriestest.Store
+	s.AddBlock(1, 1000)
+	s.AddBlock(2, 2000)
+	s.AddEvent("BlockDepth", testPool, 1000, 0)
+	return &s
+}
+
+func TestDepth(t *testing.T) {
+	tests := []struct {
+		name               string
+		events             map[string]int64
+		rune, asset, units int64
+	}{
+		{"none", nil, 0, 0, 0},
+		{"stake", map[string]int64{"TotalRuneStakes": 100, "TotalAssetStakes": 10, "TotalStakeUnits": 50}, 100, 10, 50},
+		{"unstake", map[string]int64{"TotalRuneStakes": 100, "TotalRunUnstakes": 40, "TotalStakeUnits": 50, "TotalUnstakeUnits": 20}, 60, 0, 30},
+		{"swap to asset", map[string]int64{"TotalRuneSwapIn": 20, "TotalAssetSwapOut": 2, "AssetFeesSwaps": 1, "AssetPoolDeductSwaps": 3}, 20, -6, 0},
+		{"swap to rune", map[string]int64{"TotalAssetSwapIn": 2, "TotalRuneSwapOut": 20, "RuneFeesSwaps": 1, "PoolDeductSwaps": 3}, -24, 2, 0},
+		{"fees tracked only", map[string]int64{"Fees": 7}, 0, 0, 0},
+		{"errata on both sides", map[string]int64{"Errata": 5, "AssetErrata": 3}, 5, 3, 0},
+		{"refunds", map[string]int64{"PoolDeductRefunds": 4, "AssetPoolDeductRefunds": 2}, -4, -2, 0},
+		{"gas", map[string]int64{"Gas": 9, "AssetGas": 8}, 9, -8, 0},
+	}
+	for _, test := range tests {
+		// events on the from block come with the totals query, and
+		// the ones thereafter with the delta cursors
+		for _, ts := range []int{1000, 2000} {
+			store := testStore()
+			for name, e8 := range test.events {
+				store.AddEvent(name, testPool, ts, e8)
+			}
+
+			s, err := timeseries.OpenStream(context.Background(), store, 1000, 2000)
+			if err != nil {
+				t.Fatalf("%s: open stream: %s", test.name, err)
+			}
+			if err := s.Advance(2000); err != nil {
+				t.Fatalf("%s: advance: %s", test.name, err)
+			}
+			m := s.Totals(testPool)
+			s.Close()
+
+			if got := m.Depth("rune"); got != test.rune {
+				t.Errorf("%s on block timestamp %d: got rune depth %d, want %d", test.name, ts, got, test.rune)
+			}
+			if got := m.Depth("asset"); got != test.asset {
+				t.Errorf("%s on block timestamp %d: got asset depth %d, want %d", test.name, ts, got, test.asset)
+			}
+			if got := m.Depth("units"); got != test.units {
+				t.Errorf("%s on block timestamp %d: got units %d, want %d", test.name, ts, got, test.units)
+			}
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *timeseriestest.Store)
+		want  timeseries.Status
+		e8    int64
+	}{
+		{"no rows", func(s *timeseriestest.Store) {}, timeseries.Missing, 0},
+		{"NULL only", func(s *timeseriestest.Store) {
+			s.AddNull("TotalRuneStakes", testPool, 1000)
+			s.AddNull("TotalRuneStakes", testPool, 2000)
+		}, timeseries.Missing, 0},
+		{"NULL with values", func(s *timeseriestest.Store) {
+			s.AddNull("TotalRuneStakes", testPool, 1000)
+			s.AddEvent("TotalRuneStakes", testPool, 1000, 5)
+			s.AddNull("TotalRuneStakes", testPool, 2000)
+			s.AddEvent("TotalRuneStakes", testPool, 2000, 6)
+		}, timeseries.Present, 11},
+		{"zero sum", func(s *timeseriestest.Store) {
+			s.AddEvent("TotalRuneStakes", testPool, 1000, 5)
+			s.AddEvent("TotalRuneStakes", testPool, 2000, -5)
+		}, timeseries.Zero, 0},
+		{"query error", func(s *timeseriestest.Store) {
+			s.AddEvent("TotalRuneStakes", testPool, 1000, 5)
+			s.Err = map[string]error{"TotalRuneStakes": errors.New("test failure")}
+		}, timeseries.Failed, 0},
+	}
+	index := componentIndex(t, "TotalRuneStakes")
+	for _, test := range tests {
+		store := testStore()
+		test.setup(store)
+
+		s, err := timeseries.OpenStream(context.Background(), store, 1000, 2000)
+		if err != nil {
+			t.Fatalf("%s: open stream: %s", test.name, err)
+		}
+		if err := s.Advance(2000); err != nil {
+			t.Fatalf("%s: advance: %s", test.name, err)
+		}
+		m := s.Totals(testPool)
+		s.Close()
+
+		if got := m.Status[index]; got != test.want {
+			t.Errorf("%s: got status %s, want %s", test.name, got, test.want)
+		}
+		if got := m.Values()[index]; got != test.e8 {
+			t.Errorf("%s: got value %d, want %d", test.name, got, test.e8)
+		}
+		if got, want := m.Failed("rune"), test.want == timeseries.Failed; got != want {
+			t.Errorf("%s: got rune side failed %t, want %t", test.name, got, want)
+		}
+		if m.Failed("asset") {
+			t.Errorf("%s: asset side failed", test.name)
+		}
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := timeseries.OpenStream(ctx, testStore(), 1000, 2000); !errors.Is(err, context.Canceled) {
+		t.Errorf("open stream after cancel got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestStreamTables(t *testing.T) {
+	store := testStore()
+	store.AddBlock(3, 3000)
+	store.AddEvent("TotalRuneStakes", testPool, 2000, 1)
+	store.AddEvent("TotalRuneSwapIn", testPool, 2000, 1)
+	store.AddEvent("BlockDepth", testPool, 3000, 2)
+
+	s, err := timeseries.OpenStream(context.Background(), store, 1000, 3000)
+	if err != nil {
+		t.Fatal("open stream:", err)
+	}
+	defer s.Close()
+
+	for _, step := range []struct {
+		ts   int
+		want []string
+	}{
+		{2000, []string{"stake_events", "swap_events"}},
+		{3000, nil},
+	} {
+		if err := s.Advance(step.ts); err != nil {
+			t.Fatal("advance:", err)
+		}
+		got := s.Tables(testPool)
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("block timestamp %d got tables %q, want %q", step.ts, got, step.want)
+		}
+	}
+}
+
+func TestTotalsAtHeight(t *testing.T) {
+	store := testStore()
+	store.AddEvent("BlockDepth", "BTC.BTC", 1000, 0)
+	store.AddEvent("TotalRuneStakes", testPool, 1000, 100)
+	store.AddEvent("TotalRuneStakes", "BTC.BTC", 1000, 300)
+	store.AddEvent("Gas", testPool, 2000, 7)
+	store.AddEvent("BlockDepth", testPool, 2000, 107)
+
+	tests := []struct {
+		name   string
+		height int64
+		pool   string
+		errs   map[string]error
+		ts     int
+		depths map[string]int64
+	}{
+		{"all pools", 2, "", nil, 2000, map[string]int64{testPool: 107, "BTC.BTC": 300}},
+		{"one pool", 2, testPool, nil, 2000, map[string]int64{testPool: 107}},
+		{"earlier height", 1, "", nil, 1000, map[string]int64{testPool: 100, "BTC.BTC": 300}},
+		{"unknown height", 3, "", nil, 0, map[string]int64{}},
+		{"per component", 2, testPool, map[string]error{"TotalRuneSwapIn": errors.New("test failure")}, 2000, map[string]int64{testPool: 107}},
+	}
+	for _, test := range tests {
+		store.Err = test.errs
+		ts, totals, err := timeseries.TotalsAtHeight(context.Background(), store, test.height, test.pool)
+		if err != nil {
+			t.Errorf("%s: got error: %s", test.name, err)
+			continue
+		}
+		if ts != test.ts {
+			t.Errorf("%s: got block timestamp %d, want %d", test.name, ts, test.ts)
+		}
+		depths := make(map[string]int64, len(totals))
+		for pool, m := range totals {
+			depths[pool] = m.Depth("rune")
+		}
+		if !reflect.DeepEqual(depths, test.depths) {
+			t.Errorf("%s: got rune depths %v, want %v", test.name, depths, test.depths)
+		}
+		for name := range test.errs {
+			m := totals[test.pool]
+			if got := m.Status[componentIndex(t, name)]; got != timeseries.Failed {
+				t.Errorf("%s: got %s status %s, want %s", test.name, name, got, timeseries.Failed)
+			}
+			if !m.Failed("rune") {
+				t.Errorf("%s: rune side not failed", test.name)
+			}
+		}
+	}
+}
+
+// TotalsAtHeight must agree with a Stream on each height.
+func TestTotalsAtHeightMatchesStream(t *testing.T) {
+	store := testStore()
+	store.AddBlock(3, 3000)
+	store.AddEvent("TotalRuneStakes", testPool, 1000, 100)
+	store.AddEvent("TotalAssetStakes", testPool, 2000, 10)
+	store.AddNull("Gas", testPool, 2000)
+	store.AddEvent("BlockDepth", testPool, 2000, 100)
+	store.AddEvent("TotalRunUnstakes", testPool, 3000, 100)
+
+	s, err := timeseries.OpenStream(context.Background(), store, 1000, 3000)
+	if err != nil {
+		t.Fatal("open stream:", err)
+	}
+	defer s.Close()
+
+	for height := int64(1); height <= 3; height++ {
+		ts := int(height) * 1000
+		if err := s.Advance(ts); err != nil {
+			t.Fatal("advance:", err)
+		}
+		want := s.Totals(testPool)
+
+		gotTS, totals, err := timeseries.TotalsAtHeight(context.Background(), store, height, testPool)
+		if err != nil {
+			t.Fatalf("height %d: %s", height, err)
+		}
+		if gotTS != ts {
+			t.Errorf("height %d: got block timestamp %d, want %d", height, gotTS, ts)
+		}
+		if got := totals[testPool]; !reflect.DeepEqual(got, want) {
+			t.Errorf("height %d: got %+v, want %+v", height, got, want)
+		}
+	}
+}
+
+func TestStreamExtend(t *testing.T) {
+	store := testStore()
+	store.AddBlock(3, 3000)
+	store.AddEvent("TotalAssetStakes", testPool, 2000, 10)
+	store.AddEvent("BlockDepth", testPool, 2000, 100)
+	store.AddEvent("TotalRunUnstakes", testPool, 3000, 100)
+
+	// each block in one go as reference
+	full, err := timeseries.OpenStream(context.Background(), store, 1000, 3000)
+	if err != nil {
+		t.Fatal("open stream:", err)
+	}
+	defer full.Close()
+	s, err := timeseries.OpenStream(context.Background(), store, 1000, 1000)
+	if err != nil {
+		t.Fatal("open stream:", err)
+	}
+	defer s.Close()
+
+	for ts := 2000; ts <= 3000; ts += 1000 {
+		if err := s.Advance(ts); err == nil {
+			t.Errorf("advance to %d beyond end: no error", ts)
+		}
+		if err := s.Extend(ts); err != nil {
+			t.Fatal("extend:", err)
+		}
+		if err := s.Advance(ts); err != nil {
+			t.Fatal("advance:", err)
+		}
+		if err := full.Advance(ts); err != nil {
+			t.Fatal("advance:", err)
+		}
+		if got, want := s.Totals(testPool), full.Totals(testPool); !reflect.DeepEqual(got, want) {
+			t.Errorf("block timestamp %d: got %+v, want %+v", ts, got, want)
+		}
+		if got, want := s.Tables(testPool), full.Tables(testPool); !reflect.DeepEqual(got, want) {
+			t.Errorf("block timestamp %d: got tables %q, want %q", ts, got, want)
+		}
+	}
+	if got, want := s.Pools(), []string{testPool}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got pools %q, want %q", got, want)
+	}
+}
+
+func TestSetFormula(t *testing.T) {
+	defer timeseries.SetFormula(timeseries.DefaultFormula)
+
+	tests := []struct {
+		name    string
+		formula timeseries.Formula
+		ok      bool
+	}{
+		{"default", timeseries.DefaultFormula, true},
+		{"no name", timeseries.Formula{{Side: "rune", Sign: "+", Value: "sum(e8)", From: "t", Pool: "pool", Timestamp: "block_timestamp"}}, false},
+		{"no table", timeseries.Formula{{Name: "X", Side: "rune", Sign: "+", Value: "sum(e8)", Pool: "pool", Timestamp: "block_timestamp"}}, false},
+		{"unknown side", timeseries.Formula{{Name: "X", Side: "bond", Sign: "+", Value: "sum(e8)", From: "t", Pool: "pool", Timestamp: "block_timestamp"}}, false},
+		{"unknown sign", timeseries.Formula{{Name: "X", Side: "rune", Sign: "*", Value: "sum(e8)", From: "t", Pool: "pool", Timestamp: "block_timestamp"}}, false},
+		{"block name", timeseries.Formula{{Name: "BlockDepth", Side: "rune", Sign: "+", Value: "sum(e8)", From: "t", Pool: "pool", Timestamp: "block_timestamp"}}, false},
+	}
+	for _, test := range tests {
+		err := timeseries.SetFormula(test.formula)
+		if got := err == nil; got != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}